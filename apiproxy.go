@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/mweigel/token-cache-plugin/tokencache"
+)
+
+// How long requests in progress are given to finish when the proxy is stopped, after which
+// any still open, such as watches, are cut off.
+const proxyShutdownTimeout = 5 * time.Second
+
+// Serve a local proxy to the API server of the current kubeconfig context, adding the
+// plugin's token to every request. Tools that can't run exec plugins can use it without
+// credentials of their own.
+func apiProxy(logger *leveledLogger) {
+	cluster, err := currentCluster()
+	if err != nil {
+		logger.Fatalf("Error finding API server: %s\n", err)
+	}
+	target, err := url.Parse(cluster.Server)
+	if err != nil {
+		logger.Fatalf("Error parsing API server URL: %s\n", err)
+	}
+
+	transport, err := clusterTransport(cluster)
+	if err != nil {
+		logger.Fatalf("Error creating HTTP transport: %s\n", err)
+	}
+	source, err := newTokenSource(logger)
+	if err != nil {
+		logger.Fatalf("Error %s\n", err)
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		req.Host = target.Host
+	}
+	proxy.Transport = &tokencache.Transport{Source: proxyTokenSource{source}, Base: transport}
+	// Flush immediately so watches and logs stream. Upgraded connections, used by exec,
+	// attach and port-forward, are handled by the reverse proxy itself.
+	proxy.FlushInterval = -1
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		logger.Warnf("Error proxying %s %s: %s\n", req.Method, req.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+
+	listener, err := listen(cfg.listen)
+	if err != nil {
+		logger.Fatalf("Error listening on %s: %s\n", cfg.listen, err)
+	}
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() {
+		logger.Warnf("Listening on %s, anyone able to connect can use your token\n", addr)
+	}
+	logger.Infof("Proxying %s to %s\n", listener.Addr(), target)
+
+	server := &http.Server{Handler: acceptHosts(cfg.acceptHosts, proxy)}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, append(terminalSignals, forwardedSignals...)...)
+	stopped := make(chan struct{})
+	go func() {
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), proxyShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			server.Close()
+		}
+		close(stopped)
+	}()
+	if err = server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		logger.Fatalf("Error serving proxy: %s\n", err)
+	}
+	<-stopped
+}
+
+// Refuse requests for hosts other than those accepted with 403 Forbidden, so that a web page
+// can't use the proxy by rebinding its own host name to the proxy's address.
+func acceptHosts(hosts string, next http.Handler) http.Handler {
+	accepted := map[string]bool{}
+	for _, h := range strings.Split(hosts, ",") {
+		if h = strings.Trim(strings.TrimSpace(h), "[]"); h != "" {
+			accepted[strings.ToLower(h)] = true
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !accepted[strings.ToLower(strings.Trim(host, "[]"))] {
+			http.Error(w, "host not accepted", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Listen on a TCP address or, if prefixed with unix:, a Unix socket only the current user
+// can connect to.
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix:") {
+		return net.Listen("tcp", address)
+	}
+
+	path := strings.TrimPrefix(address, "unix:")
+	// Remove a socket left behind by a proxy that didn't exit cleanly.
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := listenUnix(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, os.FileMode(0600)); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Transport to the API server, trusting the cluster's CA as kubectl would.
+func clusterTransport(cluster kubeCluster) (*http.Transport, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cluster.InsecureSkipTLSVerify,
+		ServerName:         cluster.TLSServerName,
+	}
+	if len(cluster.CertificateAuthorityData) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(cluster.CertificateAuthorityData) {
+			return nil, errors.New("no certificates found in the cluster's certificate authority")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	proxy, err := proxyFunc()
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: cfg.tlsHandshakeTimeout,
+		TLSClientConfig:     tlsConfig,
+	}, nil
+}
+
+// Token source for the proxy, discarding tokens the API server rejects so that they're
+// not reviewed and reused.
+type proxyTokenSource struct {
+	*tokenSource
+}
+
+func (s proxyTokenSource) Token(ctx context.Context) (string, error) {
+	token, _, err := s.token()
+	if err != nil {
+		s.logger.Warnf("Error acquiring token: %s\n", err)
+	}
+	return string(token), err
+}
+
+func (s proxyTokenSource) Invalidate(token string) {
+	s.logger.Infof("API server rejected token, acquiring a new one\n")
+	discardToken([]byte(token), s.logger)
+}
+
+// Stop using a token the API server rejected. It's removed from the cache, if it's still
+// the cached token, so the next token is requested rather than reviewed again.
+func discardToken(token []byte, logger *leveledLogger) {
+	forgetReview(token)
+	cached, err := readCachedToken(cfg.tokenPath, logger)
+	if err != nil || !bytes.Equal(cached, token) {
+		return
+	}
+	if err = os.Remove(cfg.tokenPath); err != nil {
+		logger.Warnf("Error removing cached token: %s\n", err)
+		return
+	}
+	if index, err := localCache().ReadIndex(); err == nil {
+		localCache().Remove(index, tokencache.Key(cfg.tokenPath))
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptHosts(t *testing.T) {
+	handler := acceptHosts("localhost,127.0.0.1,[::1], proxy.internal ", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	tests := []struct {
+		host string
+		want int
+	}{
+		{"localhost:8001", http.StatusOK},
+		{"LOCALHOST", http.StatusOK},
+		{"127.0.0.1:8001", http.StatusOK},
+		{"[::1]:8001", http.StatusOK},
+		{"[::1]", http.StatusOK},
+		{"proxy.internal:8001", http.StatusOK},
+		{"attacker.example.com:8001", http.StatusForbidden},
+		{"localhost.attacker.example.com", http.StatusForbidden},
+		{"127.0.0.2:8001", http.StatusForbidden},
+		{"", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/api/v1/pods", nil)
+		req.Host = test.host
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != test.want {
+			t.Errorf("Host %q: status %d, want %d", test.host, w.Code, test.want)
+		}
+	}
+}
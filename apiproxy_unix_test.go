@@ -0,0 +1,104 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mweigel/token-cache-plugin/devserver"
+)
+
+func TestAPIProxy(t *testing.T) {
+	e := newTestEnv(t, devserver.Config{})
+	rejected := e.issue()
+	e.cache(rejected)
+
+	// API server rejecting the cached token and accepting any other.
+	var mu sync.Mutex
+	var seen []string
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Header.Get("Authorization"))
+		mu.Unlock()
+		if r.Header.Get("Authorization") == "Bearer "+rejected {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("pods"))
+	}))
+	defer apiServer.Close()
+
+	socket := filepath.Join(e.dir, "proxy.sock")
+	done := make(chan result)
+	go func() {
+		done <- e.run("jdoe\nsecret\n", "-api-server="+apiServer.URL, "-listen=unix:"+socket, "proxy")
+	}()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Lstat(socket); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the proxy's socket")
+		}
+	}
+
+	info, err := os.Lstat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Checked as soon as the socket exists, as others could connect before a chmod.
+	if mode := info.Mode().Perm(); mode&0077 != 0 {
+		t.Errorf("socket mode = %o, want no access for others", mode)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	// The first request is rejected with the cached token, which is discarded and a new
+	// token acquired. The second uses the new token.
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get("http://localhost/api/v1/pods")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "pods" {
+			t.Errorf("request %d: %s %q, want 200 pods", i, resp.Status, body)
+		}
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	r := <-done
+	if r.code != 0 {
+		t.Fatalf("exit status %d, stderr:\n%s", r.code, r.stderr)
+	}
+
+	token := e.cached()
+	if token == rejected {
+		t.Error("rejected token is still cached")
+	}
+	want := []string{"Bearer " + rejected, "Bearer " + token, "Bearer " + token}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(seen, "\n") != strings.Join(want, "\n") {
+		t.Errorf("API server saw Authorization %q, want %q", seen, want)
+	}
+	if r.terminal != "username: password: \n" {
+		t.Errorf("terminal = %q, want a single login", r.terminal)
+	}
+}
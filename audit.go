@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mweigel/token-cache-plugin/tokencache"
+)
+
+// Audit log events and their outcomes.
+const (
+	auditCache   = "cache"
+	auditReview  = "review"
+	auditRequest = "request"
+
+	auditHit           = "hit"
+	auditMiss          = "miss"
+	auditAuthenticated = "authenticated"
+	auditRejected      = "rejected"
+	auditSuccess       = "success"
+	auditError         = "error"
+)
+
+// Audit log written to when -audit-log is set, nil otherwise.
+var auditLog *auditWriter
+
+// Single line of the audit log. The token itself is never recorded, only its fingerprint.
+type auditRecord struct {
+	Time        string `json:"time"`
+	Event       string `json:"event"`
+	Outcome     string `json:"outcome"`
+	Endpoint    string `json:"endpoint,omitempty"`
+	Username    string `json:"username,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Cached      bool   `json:"cached,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Append-only JSON lines audit log of token acquisitions, rotated once it reaches maxSize
+// bytes, keeping up to maxBackups rotated files named path.1, path.2 and so on.
+type auditWriter struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	logger     *leveledLogger
+}
+
+func newAuditWriter(path string, maxSize int64, maxBackups int, logger *leveledLogger) *auditWriter {
+	return &auditWriter{path: path, maxSize: maxSize, maxBackups: maxBackups, logger: logger}
+}
+
+// Record an event. Failing to write the audit log is logged but doesn't stop the plugin.
+// Safe to call on a nil auditWriter, in which case nothing is recorded.
+func (a *auditWriter) record(r auditRecord) {
+	if a == nil {
+		return
+	}
+	r.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	r.Error = a.logger.redact(r.Error)
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		a.logger.Warnf("Error writing audit log: %s\n", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err = a.rotate(int64(len(line))); err != nil {
+		a.logger.Warnf("Error rotating audit log: %s\n", err)
+	}
+
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, os.FileMode(0600))
+	if err != nil {
+		a.logger.Warnf("Error writing audit log: %s\n", err)
+		return
+	}
+	defer f.Close()
+	if _, err = f.Write(line); err != nil {
+		a.logger.Warnf("Error writing audit log: %s\n", err)
+	}
+}
+
+// Rotate the log if writing n more bytes would exceed maxSize.
+func (a *auditWriter) rotate(n int64) error {
+	if a.maxSize <= 0 {
+		return nil
+	}
+	info, err := os.Stat(a.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size()+n <= a.maxSize {
+		return nil
+	}
+
+	if a.maxBackups <= 0 {
+		return os.Remove(a.path)
+	}
+	os.Remove(a.backupPath(a.maxBackups))
+	for i := a.maxBackups - 1; i >= 1; i-- {
+		if err = os.Rename(a.backupPath(i), a.backupPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(a.path, a.backupPath(1))
+}
+
+func (a *auditWriter) backupPath(i int) string {
+	return fmt.Sprintf("%s.%d", a.path, i)
+}
+
+// Identify a token without revealing it.
+func tokenFingerprint(token []byte) string {
+	if len(token) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(token)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Record a token request or review made by tokenServiceClient.
+func auditTokenService(e tokencache.AuditEvent) {
+	r := auditRecord{Event: auditReview, Endpoint: e.Endpoint, Username: e.Username, Fingerprint: tokenFingerprint(e.Token)}
+	if e.Kind == tokencache.RequestEndpoint {
+		r.Event = auditRequest
+	}
+	switch {
+	case e.Err != nil:
+		r.Outcome, r.Error = auditError, e.Err.Error()
+	case e.Kind == tokencache.RequestEndpoint:
+		r.Outcome = auditSuccess
+	case e.Authenticated:
+		r.Outcome = auditAuthenticated
+	default:
+		r.Outcome = auditRejected
+	}
+	auditLog.record(r)
+}
@@ -0,0 +1,87 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	// Each record is larger than half the maximum size so every write rotates.
+	a := newAuditWriter(path, 100, 2, newLogger(&bytes.Buffer{}, levelError, false))
+	for i := 1; i <= 5; i++ {
+		a.record(auditRecord{Event: auditRequest, Outcome: auditSuccess, Username: fmt.Sprintf("user%d", i)})
+	}
+
+	for name, want := range map[string]string{"audit.log": "user5", "audit.log.1": "user4", "audit.log.2": "user3"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r auditRecord
+		if err = json.Unmarshal(b, &r); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if r.Username != want {
+			t.Errorf("%s records %s, want %s", name, r.Username, want)
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("%d files in audit log directory, want the log and 2 backups", len(files))
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("audit log mode = %o, want 600", mode)
+	}
+}
+
+func TestAuditRotationWithoutBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	a := newAuditWriter(path, 100, 0, newLogger(&bytes.Buffer{}, levelError, false))
+	a.record(auditRecord{Event: auditRequest, Outcome: auditSuccess, Username: "user1"})
+	a.record(auditRecord{Event: auditRequest, Outcome: auditSuccess, Username: "user2"})
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "audit.log" {
+		t.Errorf("audit log directory contains %d files, want only audit.log", len(files))
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte("user2")) || bytes.Contains(b, []byte("user1")) {
+		t.Errorf("audit log = %q, want only the latest record", b)
+	}
+}
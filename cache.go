@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/mweigel/token-cache-plugin/tokencache"
+)
+
+// Tokens cached in the configured cache directory, in the format shared with programs
+// using the tokencache package.
+func localCache() *tokencache.Cache {
+	return &tokencache.Cache{Dir: cfg.cacheDir, TokenPath: cfg.tokenPath, CheckDir: checkWritableDir}
+}
+
+// Paths under the home directory are stored relative to it so that exported caches can
+// be imported on machines where the home directory differs.
+func portablePath(path string) string {
+	if currentUser, err := user.Current(); err == nil {
+		if rel, err := filepath.Rel(currentUser.HomeDir, path); err == nil && !strings.HasPrefix(rel, "..") {
+			return filepath.ToSlash(filepath.Join("~", rel))
+		}
+	}
+	return path
+}
+
+func expandPath(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	if currentUser, err := user.Current(); err == nil {
+		return filepath.Join(currentUser.HomeDir, filepath.FromSlash(path[2:]))
+	}
+	return path
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mweigel/token-cache-plugin/tokencache"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Parameters used to derive the key encrypting exported caches from a passphrase.
+const (
+	exportVersion = 1
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+)
+
+// Directory within the cache directory holding imported tokens other than the token path.
+const importDir = "imported"
+
+// Encrypted cache export. The box is the secretbox sealed JSON of an exportedCache.
+type encryptedExport struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Box     []byte `json:"box"`
+}
+
+type exportedCache struct {
+	Entries []exportedEntry `json:"entries"`
+}
+
+type exportedEntry struct {
+	tokencache.Entry
+	Token []byte `json:"token"`
+}
+
+// Inspect and manage cached tokens.
+//
+//	cache list               list cached tokens
+//	cache show <key>         show a cached token's metadata and JWT claims, with the token masked
+//	cache purge [expired]    remove all cached tokens, or only those known to have expired
+//	cache export <file>      write cached tokens to a passphrase encrypted file
+//	cache import <file>      restore cached tokens from an encrypted export
+func cacheCommand(logger *leveledLogger, args []string) {
+	if len(args) == 0 {
+		logger.Fatalf("Usage: cache list|show <key>|purge [expired]|export <file>|import <file>\n")
+	}
+
+	index, err := localCache().ReadIndex()
+	if err != nil {
+		logger.Fatalf("Error reading cache index: %s\n", err)
+	}
+
+	switch args[0] {
+	case "list":
+		err = cacheList(stdout, index, time.Now())
+	case "show":
+		if len(args) != 2 {
+			logger.Fatalf("Usage: cache show <key>\n")
+		}
+		err = cacheShow(stdout, index, args[1], logger)
+	case "purge":
+		expiredOnly := len(args) > 1 && args[1] == "expired"
+		err = cachePurge(logger, index, expiredOnly, time.Now())
+	case "export":
+		if len(args) != 2 {
+			logger.Fatalf("Usage: cache export <file>\n")
+		}
+		err = cacheExport(index, args[1], logger)
+	case "import":
+		if len(args) != 2 {
+			logger.Fatalf("Usage: cache import <file>\n")
+		}
+		err = cacheImport(logger, index, args[1])
+	default:
+		logger.Fatalf("Unknown cache command: %s\n", args[0])
+	}
+	if err != nil {
+		logger.Fatalf("Error running cache %s: %s\n", args[0], err)
+	}
+}
+
+func sortedCacheKeys(index map[string]tokencache.Entry) []string {
+	keys := make([]string, 0, len(index))
+	for k := range index {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return index[keys[i]].Path < index[keys[j]].Path })
+	return keys
+}
+
+// Describe when a cached token expires, if known.
+func describeExpiry(path string, now time.Time) string {
+	token, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "missing"
+	}
+	expiry, ok := tokencache.Expiry(token)
+	if !ok {
+		return "unknown"
+	}
+	if expiry.Before(now) {
+		return fmt.Sprintf("expired %s", expiry.Format(time.RFC3339))
+	}
+	return expiry.Format(time.RFC3339)
+}
+
+func cacheList(w io.Writer, index map[string]tokencache.Entry, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tPATH\tENDPOINT\tUSER\tEXPIRES\tBACKEND")
+	for _, k := range sortedCacheKeys(index) {
+		e := index[k]
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", k, e.Path, orUnknown(e.Endpoint), orUnknown(e.Username), describeExpiry(e.Path, now), e.Backend)
+	}
+	return tw.Flush()
+}
+
+func cacheShow(w io.Writer, index map[string]tokencache.Entry, key string, logger *leveledLogger) error {
+	e, ok := index[key]
+	if !ok {
+		return fmt.Errorf("no cached token with key %s", key)
+	}
+	token, err := readCachedToken(e.Path, logger)
+	if err != nil {
+		return err
+	}
+	logger.addSecret(string(token))
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "KEY\t%s\n", key)
+	fmt.Fprintf(tw, "PATH\t%s\n", e.Path)
+	fmt.Fprintf(tw, "ENDPOINT\t%s\n", orUnknown(e.Endpoint))
+	fmt.Fprintf(tw, "USER\t%s\n", orUnknown(e.Username))
+	fmt.Fprintf(tw, "CACHED\t%s\n", e.CachedAt.Format(time.RFC3339))
+	fmt.Fprintf(tw, "EXPIRES\t%s\n", describeExpiry(e.Path, time.Now()))
+	fmt.Fprintf(tw, "BACKEND\t%s\n", e.Backend)
+	fmt.Fprintf(tw, "FINGERPRINT\t%s\n", tokenFingerprint(token))
+	fmt.Fprintf(tw, "TOKEN\t%s\n", maskToken(token))
+	if err = tw.Flush(); err != nil {
+		return err
+	}
+
+	claims, err := tokencache.Claims(token)
+	if err != nil {
+		_, err = fmt.Fprintln(w, "CLAIMS    token is not a JWT")
+		return err
+	}
+	b, err := json.MarshalIndent(claims, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "CLAIMS\n%s\n", b)
+	return err
+}
+
+// Show just enough of a token to tell tokens apart.
+func maskToken(token []byte) string {
+	if len(token) < 16 {
+		return "****"
+	}
+	return fmt.Sprintf("%s...%s (%d bytes)", token[:4], token[len(token)-4:], len(token))
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// Remove cached tokens. If expiredOnly is set only tokens known to have expired are removed,
+// tokens without an expiry are kept.
+func cachePurge(logger *leveledLogger, index map[string]tokencache.Entry, expiredOnly bool, now time.Time) error {
+	purged := 0
+	for _, k := range sortedCacheKeys(index) {
+		e := index[k]
+		if expiredOnly {
+			token, err := ioutil.ReadFile(e.Path)
+			if err == nil {
+				if expiry, ok := tokencache.Expiry(token); !ok || expiry.After(now) {
+					continue
+				}
+			}
+		}
+		if err := localCache().Remove(index, k); err != nil {
+			return err
+		}
+		logger.Infof("Removed %s %s\n", k, e.Path)
+		purged++
+	}
+	logger.Infof("Purged %d cached token(s)\n", purged)
+	return nil
+}
+
+func cacheExport(index map[string]tokencache.Entry, path string, logger *leveledLogger) error {
+	var export exportedCache
+	for _, k := range sortedCacheKeys(index) {
+		e := index[k]
+		token, err := readCachedToken(e.Path, logger)
+		if err != nil {
+			logger.Warnf("Not exporting %s: %s\n", k, err)
+			continue
+		}
+		logger.addSecret(string(token))
+		e.Path = portablePath(e.Path)
+		export.Entries = append(export.Entries, exportedEntry{Entry: e, Token: token})
+	}
+	if len(export.Entries) == 0 {
+		return errors.New("no cached tokens to export")
+	}
+
+	passphrase, err := promptSecret("Enter a passphrase to encrypt the export", "passphrase: ")
+	if err != nil {
+		return err
+	}
+	confirm, err := promptSecret("Enter the passphrase again", "confirm passphrase: ")
+	if err != nil {
+		return err
+	}
+	if passphrase != confirm {
+		return errors.New("passphrases don't match")
+	}
+
+	plaintext, err := json.Marshal(export)
+	if err != nil {
+		return err
+	}
+	sealed, err := sealExport(plaintext, passphrase)
+	if err != nil {
+		return err
+	}
+	if err = writePrivateFile(path, sealed); err != nil {
+		return err
+	}
+	logger.Infof("Exported %d cached token(s) to %s\n", len(export.Entries), path)
+	return nil
+}
+
+func cacheImport(logger *leveledLogger, index map[string]tokencache.Entry, path string) error {
+	sealed, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	passphrase, err := promptSecret(fmt.Sprintf("Enter the passphrase for %s", path), "passphrase: ")
+	if err != nil {
+		return err
+	}
+	plaintext, err := openExport(sealed, passphrase)
+	if err != nil {
+		return err
+	}
+
+	var export exportedCache
+	if err = json.Unmarshal(plaintext, &export); err != nil {
+		return err
+	}
+	for _, e := range export.Entries {
+		logger.addSecret(string(e.Token))
+		dest, err := importDestination(e.Path)
+		if err != nil {
+			logger.Warnf("Not importing %s: %s\n", e.Path, err)
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(dest), os.FileMode(0700)); err != nil {
+			return err
+		}
+		if err = localCache().Store(dest, e.Token, e.Entry); err != nil {
+			return err
+		}
+		logger.Infof("Imported %s %s\n", tokencache.Key(dest), dest)
+	}
+	return nil
+}
+
+// Where to import a token exported from path. The export can't be trusted to choose where
+// files are written, so the token path is only used if it's the one configured, other tokens
+// exported from under the home directory are imported under the cache directory.
+func importDestination(path string) (string, error) {
+	if expandPath(path) == cfg.tokenPath {
+		return cfg.tokenPath, nil
+	}
+	if !strings.HasPrefix(path, "~/") {
+		return "", errors.New("path isn't under the home directory")
+	}
+	rel := filepath.FromSlash(path[2:])
+	if filepath.IsAbs(rel) || filepath.VolumeName(rel) != "" {
+		return "", errors.New("path is absolute")
+	}
+	for _, name := range strings.Split(filepath.ToSlash(rel), "/") {
+		if name == ".." {
+			return "", errors.New("path contains ..")
+		}
+	}
+	rel = filepath.Clean(rel)
+	if rel == "." {
+		return "", errors.New("path is empty")
+	}
+	return filepath.Join(cfg.cacheDir, importDir, rel), nil
+}
+
+// Encrypt an export with a key derived from the passphrase using scrypt.
+func sealExport(plaintext []byte, passphrase string) ([]byte, error) {
+	e := encryptedExport{Version: exportVersion, Salt: make([]byte, 16), Nonce: make([]byte, 24)}
+	if _, err := rand.Read(e.Salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(e.Nonce); err != nil {
+		return nil, err
+	}
+	key, err := exportKey(passphrase, e.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], e.Nonce)
+	e.Box = secretbox.Seal(nil, plaintext, &nonce, key)
+	return json.Marshal(e)
+}
+
+func openExport(sealed []byte, passphrase string) ([]byte, error) {
+	var e encryptedExport
+	if err := json.Unmarshal(sealed, &e); err != nil {
+		return nil, fmt.Errorf("not a cache export: %s", err)
+	}
+	if e.Version != exportVersion || len(e.Nonce) != 24 {
+		return nil, fmt.Errorf("unsupported cache export version %d", e.Version)
+	}
+	key, err := exportKey(passphrase, e.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], e.Nonce)
+	plaintext, ok := secretbox.Open(nil, e.Box, &nonce, key)
+	if !ok {
+		return nil, errors.New("incorrect passphrase or corrupt export")
+	}
+	return plaintext, nil
+}
+
+func exportKey(passphrase string, salt []byte) (*[32]byte, error) {
+	derived, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	copy(key[:], derived)
+	return &key, nil
+}
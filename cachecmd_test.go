@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mweigel/token-cache-plugin/devserver"
+	"github.com/mweigel/token-cache-plugin/tokencache"
+)
+
+func TestSealExport(t *testing.T) {
+	sealed, err := sealExport([]byte("cached tokens"), "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(sealed), "cached tokens") {
+		t.Error("export contains the plaintext")
+	}
+	plaintext, err := openExport(sealed, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "cached tokens" {
+		t.Errorf("plaintext = %q, want %q", plaintext, "cached tokens")
+	}
+	if _, err = openExport(sealed, "wrong horse"); err == nil {
+		t.Error("opened the export with the wrong passphrase")
+	}
+	if _, err = openExport([]byte("not json"), "correct horse"); err == nil {
+		t.Error("opened an export that isn't JSON")
+	}
+}
+
+func TestCacheExportImport(t *testing.T) {
+	e := newTestEnv(t, devserver.Config{})
+	token := e.issue()
+	e.cache(token)
+	export := filepath.Join(e.dir, "export")
+
+	if r := e.run("passphrase\npassphrase\n", "cache", "export", export); r.code != 0 {
+		t.Fatalf("export failed: %s", r.stderr)
+	}
+	if err := os.Remove(filepath.Join(e.dir, "token")); err != nil {
+		t.Fatal(err)
+	}
+	if r := e.run("wrong\n", "cache", "import", export); r.code == 0 {
+		t.Error("imported with the wrong passphrase")
+	}
+	if r := e.run("passphrase\n", "cache", "import", export); r.code != 0 {
+		t.Fatalf("import failed: %s", r.stderr)
+	}
+	if cached := e.cached(); cached != token {
+		t.Errorf("imported token = %q, want %q", cached, token)
+	}
+}
+
+func TestCacheImportPaths(t *testing.T) {
+	e := newTestEnv(t, devserver.Config{})
+	outside := filepath.Join(e.dir, "outside")
+	export := exportedCache{Entries: []exportedEntry{
+		{Entry: tokencache.Entry{Path: "~/.kube/prod-token"}, Token: []byte("prod")},
+		{Entry: tokencache.Entry{Path: outside}, Token: []byte("absolute")},
+		{Entry: tokencache.Entry{Path: "~/../../" + outside}, Token: []byte("parent")},
+		{Entry: tokencache.Entry{Path: "~/.kube/../../escape"}, Token: []byte("parent")},
+		{Entry: tokencache.Entry{Path: "relative"}, Token: []byte("relative")},
+	}}
+	plaintext, err := json.Marshal(export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := sealExport(plaintext, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(e.dir, "export")
+	if err = ioutil.WriteFile(path, sealed, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := e.run("passphrase\n", "cache", "import", path)
+	if r.code != 0 {
+		t.Fatalf("import failed: %s", r.stderr)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(e.dir, "cache", importDir, ".kube", "prod-token"))
+	if err != nil || string(b) != "prod" {
+		t.Errorf("token from under the home directory = %q, %v, want it under the cache directory", b, err)
+	}
+	if _, err = os.Stat(outside); !os.IsNotExist(err) {
+		t.Errorf("imported to a path outside the cache: %v", err)
+	}
+	if strings.Count(r.stderr, "Not importing") != 4 {
+		t.Errorf("stderr = %q, want 4 paths refused", r.stderr)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// Client certificates already loaded, keyed by the files they were loaded from. The same
+// certificate is often used for both endpoints, and by doctor for each check, so this
+// avoids prompting for a PKCS#12 password more than once.
+var loadedCertificates = map[string]*tls.Certificate{}
+
+// Load the client certificate presented to the token endpoints, either from a PEM encoded
+// certificate and key or a PKCS#12 bundle. Returns nil if no client certificate is configured.
+func loadClientCertificate(s tlsSettings) (*tls.Certificate, error) {
+	switch {
+	case s.clientPKCS12 != "" && (s.clientCert != "" || s.clientKey != ""):
+		return nil, errors.New("client-pkcs12 can't be used with client-cert or client-key")
+	case s.clientPKCS12 != "":
+		return loadCertificateOnce("pkcs12:"+s.clientPKCS12, func() (*tls.Certificate, error) {
+			return loadPKCS12(s.clientPKCS12)
+		})
+	case s.clientCert != "" && s.clientKey != "":
+		return loadCertificateOnce("pem:"+s.clientCert+"\x00"+s.clientKey, func() (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(s.clientCert, s.clientKey)
+			if err != nil {
+				return nil, err
+			}
+			return &cert, nil
+		})
+	case s.clientCert != "" || s.clientKey != "":
+		return nil, errors.New("client-cert and client-key must be specified together")
+	}
+	return nil, nil
+}
+
+func loadCertificateOnce(key string, load func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	if cert, ok := loadedCertificates[key]; ok {
+		return cert, nil
+	}
+	cert, err := load()
+	if err != nil {
+		return nil, err
+	}
+	loadedCertificates[key] = cert
+	return cert, nil
+}
+
+// Decode a PKCS#12 bundle, first trying an empty password before prompting for one.
+func loadPKCS12(path string) (*tls.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks, err := pkcs12.ToPEM(data, "")
+	if err == pkcs12.ErrIncorrectPassword {
+		password, perr := promptSecret(fmt.Sprintf("Enter the password for %s", path), "pkcs12 password: ")
+		if perr != nil {
+			return nil, perr
+		}
+		blocks, err = pkcs12.ToPEM(data, password)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode %s: %s", path, err)
+	}
+
+	var certPEM, keyPEM []byte
+	for _, b := range blocks {
+		switch b.Type {
+		case "CERTIFICATE":
+			certPEM = append(certPEM, pem.EncodeToMemory(b)...)
+		case "PRIVATE KEY":
+			keyPEM = append(keyPEM, pem.EncodeToMemory(b)...)
+		}
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode %s: %s", path, err)
+	}
+	return &cert, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+// testdata/client.p12 holds a self-signed client certificate protected by the password "secret".
+func TestClientPKCS12PromptedOnce(t *testing.T) {
+	cfg = config{tls: tlsSettings{clientPKCS12: "testdata/client.p12"}}
+	loadedCertificates = map[string]*tls.Certificate{}
+	defer func() { cfg = config{} }()
+
+	term := &fakeTerminal{in: strings.NewReader("secret\n"), out: &bytes.Buffer{}}
+	openTerminal = func() (terminalIO, error) { return term, nil }
+	defer func() { openTerminal = openControllingTerminal }()
+
+	logger := newLogger(&bytes.Buffer{}, levelInfo, false)
+	// Both endpoints, then again as doctor does for each check.
+	for i := 0; i < 2; i++ {
+		if _, _, err := getHTTPClients(logger); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if prompts := strings.Count(term.out.String(), "pkcs12 password: "); prompts != 1 {
+		t.Errorf("prompted %d times for the PKCS#12 password, want once", prompts)
+	}
+}
+
+func TestClientCertificateErrors(t *testing.T) {
+	tests := []tlsSettings{
+		{clientPKCS12: "testdata/client.p12", clientCert: "cert.pem"},
+		{clientCert: "cert.pem"},
+		{clientKey: "key.pem"},
+	}
+	for _, s := range tests {
+		if _, err := loadClientCertificate(s); err == nil {
+			t.Errorf("loadClientCertificate(%+v) succeeded, want error", s)
+		}
+	}
+}
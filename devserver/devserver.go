@@ -0,0 +1,260 @@
+// Package devserver is a reference token service for development and testing. It
+// implements the kubernetes-ldap token request endpoint with users from a file instead
+// of LDAP, a webhook TokenReview endpoint and RFC 7009 revocation, and can inject
+// latency and errors to exercise clients.
+package devserver
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mweigel/token-cache-plugin/tokencache"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Paths served, matching kubernetes-ldap.
+const (
+	RequestPath    = "/ldapAuth"
+	ReviewPath     = "/authenticate"
+	RevocationPath = "/revoke"
+)
+
+// User that can be issued tokens.
+type User struct {
+	Name string
+	// Plain text password, or a bcrypt hash as written by htpasswd -B.
+	Password string
+	Groups   []string
+}
+
+// Config of a Server. The zero value issues tokens that never expire without faults.
+type Config struct {
+	Users []User
+	// Lifetime of issued tokens, which never expire if 0.
+	TokenTTL time.Duration
+	// Delay before every response.
+	Latency time.Duration
+	// Fraction of requests, between 0 and 1, answered with ErrorStatus.
+	ErrorRate float64
+	// Status of injected errors, 500 if 0.
+	ErrorStatus int
+	// Fraction of reviews, between 0 and 1, answered with a body that isn't a TokenReview.
+	MalformedRate float64
+}
+
+// Server issues and reviews tokens. It's safe for concurrent use.
+type Server struct {
+	config Config
+
+	mu     sync.Mutex
+	tokens map[string]issued
+}
+
+type issued struct {
+	user    User
+	expires time.Time
+}
+
+// New returns a server with the given configuration.
+func New(config Config) *Server {
+	if config.ErrorStatus == 0 {
+		config.ErrorStatus = http.StatusInternalServerError
+	}
+	return &Server{config: config, tokens: map[string]issued{}}
+}
+
+// ServeHTTP implements http.Handler, serving the request, review and revocation endpoints.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.config.Latency > 0 {
+		time.Sleep(s.config.Latency)
+	}
+	if chance(s.config.ErrorRate) {
+		http.Error(w, "injected error", s.config.ErrorStatus)
+		return
+	}
+
+	switch r.URL.Path {
+	case RequestPath:
+		s.request(w, r)
+	case ReviewPath:
+		s.review(w, r)
+	case RevocationPath:
+		s.revoke(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Issue a token to a user authenticated with basic auth.
+func (s *Server) request(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="devserver"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	user, ok := s.authenticate(username, password)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	now := time.Now()
+	var expires time.Time
+	if s.config.TokenTTL > 0 {
+		expires = now.Add(s.config.TokenTTL)
+	}
+	token, err := newToken(user.Name, now, expires)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.mu.Lock()
+	s.tokens[token] = issued{user: user, expires: expires}
+	s.mu.Unlock()
+	fmt.Fprint(w, token)
+}
+
+// Answer a webhook TokenReview.
+func (s *Server) review(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req tokencache.TokenReviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if chance(s.config.MalformedRate) {
+		fmt.Fprint(w, `{"status":`)
+		return
+	}
+
+	res := tokencache.TokenReviewResponse{APIVersion: req.APIVersion, Kind: "TokenReview"}
+	if user, ok := s.lookup(req.Spec["token"], time.Now()); ok {
+		res.Status = tokencache.Status{
+			Authenticated: true,
+			User:          tokencache.User{Username: user.Name, UID: user.Name, Groups: user.Groups},
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// Revoke a token sent as an RFC 7009 form or, with DELETE, as a bearer token. Unknown
+// tokens are accepted as the RFC requires.
+func (s *Server) revoke(w http.ResponseWriter, r *http.Request) {
+	var token string
+	switch r.Method {
+	case "POST":
+		token = r.PostFormValue("token")
+	case "DELETE":
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.Lock()
+	delete(s.tokens, token)
+	s.mu.Unlock()
+}
+
+func (s *Server) authenticate(username, password string) (User, bool) {
+	for _, u := range s.config.Users {
+		if u.Name != username {
+			continue
+		}
+		if strings.HasPrefix(u.Password, "$2") {
+			return u, bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) == nil
+		}
+		return u, u.Password == password
+	}
+	return User{}, false
+}
+
+// Find the user a token was issued to, if it's still valid.
+func (s *Server) lookup(token string, now time.Time) (User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[token]
+	if !ok {
+		return User{}, false
+	}
+	if !t.expires.IsZero() && now.After(t.expires) {
+		delete(s.tokens, token)
+		return User{}, false
+	}
+	return t.user, true
+}
+
+// Tokens are unsigned JWTs so that clients can read their expiry. They're only valid
+// while the server remembers issuing them.
+func newToken(username string, now, expires time.Time) (string, error) {
+	claims := map[string]interface{}{"sub": username, "iat": now.Unix()}
+	if !expires.IsZero() {
+		claims["exp"] = expires.Unix()
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, 16)
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." +
+		enc.EncodeToString(payload) + "." + enc.EncodeToString(nonce), nil
+}
+
+func chance(rate float64) bool {
+	return rate > 0 && mathrand.Float64() < rate
+}
+
+// ReadUsers reads users from a file with a line per user of the form
+// name:password[:group,group...]. Passwords may be bcrypt hashes. Blank lines and lines
+// starting with # are ignored.
+func ReadUsers(path string) ([]User, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var users []User
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) < 2 || fields[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected name:password[:groups]", path, n)
+		}
+		u := User{Name: fields[0], Password: fields[1]}
+		if len(fields) == 3 && fields[2] != "" {
+			u.Groups = strings.Split(fields[2], ",")
+		}
+		users = append(users, u)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, errors.New("no users in " + path)
+	}
+	return users, nil
+}
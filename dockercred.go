@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/mweigel/token-cache-plugin/tokencache"
+)
+
+// Docker runs credential helpers named docker-credential-<name> found on the PATH.
+// https://github.com/docker/docker-credential-helpers
+const dockerCredentialPrefix = "docker-credential-"
+
+// Message Docker recognises as meaning there are no credentials for a registry.
+const dockerCredentialsNotFound = "credentials not found in native keychain"
+
+// Docker doesn't pass any flags to credential helpers, so they're read one per line from
+// this file in the default cache directory.
+const dockerCredentialFlagsFile = "docker-credential-flags"
+
+// Credentials exchanged with Docker.
+type dockerCredentials struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+// Report whether the binary has been invoked by Docker as a credential helper, i.e. it's
+// been linked or copied to docker-credential-<name>.
+func isDockerCredentialHelper() bool {
+	return strings.HasPrefix(filepath.Base(os.Args[0]), dockerCredentialPrefix)
+}
+
+// Read flags for credential helper mode, ignoring blank lines and comments.
+func readDockerCredentialFlags() ([]string, error) {
+	currentUser, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(currentUser.HomeDir, ".k8s-token-cache", dockerCredentialFlagsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var flags []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			flags = append(flags, line)
+		}
+	}
+	return flags, scanner.Err()
+}
+
+// Act as a Docker credential helper, handing out the same tokens as the exec plugin.
+// Errors are written to stdout, where Docker expects them, as well as being logged.
+func dockerCredentialHelper(logger *leveledLogger, args []string) {
+	if len(args) != 1 {
+		logger.Fatalf("Usage: docker-credential get|store|erase|list\n")
+	}
+
+	if err := dockerCredentialAction(logger, args[0], stdin, stdout); err != nil {
+		fmt.Fprintln(stdout, err)
+		logger.Fatalf("Error running docker-credential %s: %s\n", args[0], err)
+	}
+}
+
+func dockerCredentialAction(logger *leveledLogger, action string, in io.Reader, out io.Writer) error {
+	switch action {
+	case "get":
+		serverURL, err := readServerURL(in)
+		if err != nil {
+			return err
+		}
+		if !servesRegistry(serverURL) {
+			return errors.New(dockerCredentialsNotFound)
+		}
+
+		source, err := newTokenSource(logger)
+		if err != nil {
+			return err
+		}
+		token, user, err := source.token()
+		if err != nil {
+			return err
+		}
+		return json.NewEncoder(out).Encode(dockerCredentials{
+			ServerURL: serverURL,
+			Username:  dockerUsername(user),
+			Secret:    string(token),
+		})
+
+	case "store":
+		// Tokens are only ever cached by the plugin itself, so that a password given to
+		// docker login is never mistaken for a token.
+		if _, err := ioutil.ReadAll(in); err != nil {
+			return err
+		}
+		logger.Debugf("Ignoring docker-credential store, tokens are acquired by the plugin\n")
+		return nil
+
+	case "erase":
+		serverURL, err := readServerURL(in)
+		if err != nil {
+			return err
+		}
+		if !servesRegistry(serverURL) {
+			return nil
+		}
+		_, revokeErr, err := removeCachedToken(logger)
+		if err != nil {
+			return err
+		}
+		if revokeErr != nil {
+			logger.Warnf("Removed cached token but revocation failed: %s\n", revokeErr)
+		}
+		return nil
+
+	case "list":
+		registries := map[string]string{}
+		for _, r := range cfg.dockerRegistries {
+			registries[r] = dockerUsername(k8suser{})
+		}
+		return json.NewEncoder(out).Encode(registries)
+	}
+	return fmt.Errorf("unknown docker-credential action: %s", action)
+}
+
+func readServerURL(in io.Reader) (string, error) {
+	b, err := ioutil.ReadAll(in)
+	if err != nil {
+		return "", err
+	}
+	serverURL := strings.TrimSpace(string(b))
+	if serverURL == "" {
+		return "", errors.New("no server URL")
+	}
+	return serverURL, nil
+}
+
+// Report whether credentials should be handed out for a registry. Registries are compared
+// by host, as Docker passes server URLs with and without a scheme and path.
+func servesRegistry(serverURL string) bool {
+	if len(cfg.dockerRegistries) == 0 {
+		return true
+	}
+	host := registryHost(serverURL)
+	for _, r := range cfg.dockerRegistries {
+		if registryHost(r) == host {
+			return true
+		}
+	}
+	return false
+}
+
+func registryHost(serverURL string) string {
+	if !strings.Contains(serverURL, "://") {
+		serverURL = "https://" + serverURL
+	}
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return serverURL
+	}
+	return strings.ToLower(u.Host)
+}
+
+// Username sent to the registry alongside the token. Registries accepting the token as a
+// password typically only need the username to be non-empty.
+func dockerUsername(u k8suser) string {
+	if u.Username != "" {
+		return u.Username
+	}
+	if username := defaultUsername(); username != "" {
+		return username
+	}
+	if index, err := localCache().ReadIndex(); err == nil {
+		if e := index[tokencache.Key(cfg.tokenPath)]; e.Username != "" {
+			return e.Username
+		}
+	}
+	return "token"
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mweigel/token-cache-plugin/devserver"
+)
+
+func TestDockerCredentialGet(t *testing.T) {
+	e := newTestEnv(t, devserver.Config{})
+	token := e.issue()
+	e.cache(token)
+
+	r := e.runStdin("registry.example.com\n", "", "-docker-registry=https://registry.example.com/v2/", "docker-credential", "get")
+	if r.code != 0 {
+		t.Fatalf("exit status %d, stderr:\n%s", r.code, r.stderr)
+	}
+	var creds dockerCredentials
+	if err := json.Unmarshal([]byte(r.stdout), &creds); err != nil {
+		t.Fatalf("decoding credentials %q: %s", r.stdout, err)
+	}
+	want := dockerCredentials{ServerURL: "registry.example.com", Username: "jdoe", Secret: token}
+	if creds != want {
+		t.Errorf("credentials = %+v, want %+v", creds, want)
+	}
+}
+
+func TestDockerCredentialGetUnservedRegistry(t *testing.T) {
+	e := newTestEnv(t, devserver.Config{})
+	e.cache(e.issue())
+
+	r := e.runStdin("other.example.com\n", "", "-docker-registry=registry.example.com", "docker-credential", "get")
+	if r.code == 0 {
+		t.Error("get for an unserved registry succeeded")
+	}
+	if r.stdout != "credentials not found in native keychain\n" {
+		t.Errorf("stdout = %q, want Docker's credentials not found message", r.stdout)
+	}
+}
+
+func TestDockerCredentialStore(t *testing.T) {
+	e := newTestEnv(t, devserver.Config{})
+	token := e.issue()
+	e.cache(token)
+
+	r := e.runStdin(`{"ServerURL":"registry.example.com","Username":"jdoe","Secret":"password"}`, "", "docker-credential", "store")
+	if r.code != 0 || r.stdout != "" {
+		t.Errorf("exit status %d, stdout %q, want store ignored", r.code, r.stdout)
+	}
+	if cached := e.cached(); cached != token {
+		t.Errorf("cached token = %q, want %q unchanged by store", cached, token)
+	}
+}
+
+func TestDockerCredentialErase(t *testing.T) {
+	e := newTestEnv(t, devserver.Config{})
+	e.cache(e.issue())
+	tokenPath := filepath.Join(e.dir, "token")
+
+	r := e.runStdin("other.example.com\n", "", "-docker-registry=registry.example.com", "docker-credential", "erase")
+	if r.code != 0 {
+		t.Fatalf("exit status %d, stderr:\n%s", r.code, r.stderr)
+	}
+	if _, err := os.Stat(tokenPath); err != nil {
+		t.Errorf("erase for an unserved registry removed the cached token: %s", err)
+	}
+
+	r = e.runStdin("registry.example.com\n", "", "-docker-registry=registry.example.com", "docker-credential", "erase")
+	if r.code != 0 {
+		t.Fatalf("exit status %d, stderr:\n%s", r.code, r.stderr)
+	}
+	if _, err := os.Stat(tokenPath); !os.IsNotExist(err) {
+		t.Errorf("cached token still exists after erase: %v", err)
+	}
+}
+
+func TestDockerCredentialList(t *testing.T) {
+	e := newTestEnv(t, devserver.Config{})
+
+	r := e.runStdin("", "", "-username=jdoe", "-docker-registry=registry.example.com", "-docker-registry=mirror.example.com", "docker-credential", "list")
+	if r.code != 0 {
+		t.Fatalf("exit status %d, stderr:\n%s", r.code, r.stderr)
+	}
+	var registries map[string]string
+	if err := json.Unmarshal([]byte(r.stdout), &registries); err != nil {
+		t.Fatalf("decoding registries %q: %s", r.stdout, err)
+	}
+	if len(registries) != 2 || registries["registry.example.com"] != "jdoe" || registries["mirror.example.com"] != "jdoe" {
+		t.Errorf("registries = %v, want both registries listed for jdoe", registries)
+	}
+}
+
+func TestServesRegistry(t *testing.T) {
+	defer func() { cfg = config{} }()
+
+	tests := []struct {
+		registries []string
+		serverURL  string
+		want       bool
+	}{
+		{nil, "anything.example.com", true},
+		{[]string{"registry.example.com"}, "registry.example.com", true},
+		{[]string{"registry.example.com"}, "https://registry.example.com/v2/", true},
+		{[]string{"https://Registry.example.com"}, "registry.example.com", true},
+		{[]string{"registry.example.com:5000"}, "registry.example.com:5000/v1/", true},
+		{[]string{"registry.example.com"}, "registry.example.com:5000", false},
+		{[]string{"registry.example.com"}, "other.example.com", false},
+		{[]string{"registry.example.com", "mirror.example.com"}, "http://mirror.example.com", true},
+	}
+	for _, test := range tests {
+		cfg = config{dockerRegistries: test.registries}
+		if got := servesRegistry(test.serverURL); got != test.want {
+			t.Errorf("servesRegistry(%q) with registries %v = %t, want %t", test.serverURL, test.registries, got, test.want)
+		}
+	}
+}
+
+func TestRegistryHost(t *testing.T) {
+	for serverURL, want := range map[string]string{
+		"registry.example.com":                  "registry.example.com",
+		"Registry.Example.com:5000":             "registry.example.com:5000",
+		"https://registry.example.com/v2/":      "registry.example.com",
+		"https://index.docker.io/v1/":           "index.docker.io",
+		"http://localhost:5000/v2/library/test": "localhost:5000",
+	} {
+		if got := registryHost(serverURL); got != want {
+			t.Errorf("registryHost(%q) = %q, want %q", serverURL, got, want)
+		}
+	}
+}
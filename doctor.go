@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mweigel/token-cache-plugin/tokencache"
+)
+
+// Outcomes of a doctor check.
+const (
+	checkPass = "PASS"
+	checkWarn = "WARN"
+	checkFail = "FAIL"
+)
+
+// Certificates expiring within this period are warned about.
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// Report of doctor checks written as they're run.
+type doctorReport struct {
+	w        io.Writer
+	failures int
+}
+
+func (r *doctorReport) result(status, name, message, hint string, details ...string) {
+	if status == checkFail {
+		r.failures++
+	}
+	fmt.Fprintf(r.w, "[%s] %s: %s\n", status, name, message)
+	for _, d := range details {
+		fmt.Fprintf(r.w, "       %s\n", d)
+	}
+	if hint != "" && status != checkPass {
+		fmt.Fprintf(r.w, "       hint: %s\n", hint)
+	}
+}
+
+// Check each stage of acquiring a token separately and print a pass/fail report with
+// hints on how to fix any problems found. Exits non-zero if any check fails.
+func doctor(logger *leveledLogger) {
+	r := &doctorReport{w: stdout}
+
+	checkConfig(r)
+	checkCacheFile(r, "cache file", cfg.tokenPath)
+	checkCacheFile(r, "cache directory", cfg.cacheDir)
+	checkEndpoints(r, requestEndpoint, cfg.tokenRequestEndpoints, cfg.requestTLS.merge(cfg.tls))
+	checkEndpoints(r, reviewEndpoint, cfg.tokenReviewEndpoints, cfg.reviewTLS.merge(cfg.tls))
+	checkCachedToken(r, logger)
+	checkKubeconfig(r)
+
+	if r.failures > 0 {
+		logger.Fatalf("%d check(s) failed\n", r.failures)
+	}
+}
+
+func checkConfig(r *doctorReport) {
+	var problems []string
+	if len(cfg.tokenRequestEndpoints) == 0 {
+		problems = append(problems, "-token-request-endpoint is not set")
+	}
+	if len(cfg.tokenReviewEndpoints) == 0 {
+		problems = append(problems, "-token-review-endpoint is not set")
+	}
+	for _, u := range append(append([]string{}, cfg.tokenRequestEndpoints...), cfg.tokenReviewEndpoints...) {
+		parsed, err := url.Parse(u)
+		if err != nil || parsed.Host == "" {
+			problems = append(problems, fmt.Sprintf("%s is not a valid URL", u))
+		} else if parsed.Scheme != "https" {
+			problems = append(problems, fmt.Sprintf("%s doesn't use https, credentials and tokens would be sent in the clear", u))
+		}
+	}
+	switch cfg.otpMode {
+	case otpModeNone, otpModeAppend, otpModeHeader:
+	default:
+		problems = append(problems, fmt.Sprintf("-otp-mode %q is not one of append or header", cfg.otpMode))
+	}
+	switch cfg.revocationMethod {
+	case revocationRFC7009, revocationDelete:
+	default:
+		problems = append(problems, fmt.Sprintf("-revocation-method %q is not one of rfc7009 or delete", cfg.revocationMethod))
+	}
+	for _, s := range []tlsSettings{cfg.requestTLS.merge(cfg.tls), cfg.reviewTLS.merge(cfg.tls)} {
+		if s.minVersion != "" {
+			if _, err := parseTLSVersion(s.minVersion); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+		if _, err := parsePins(s.pins); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if s.skipTLSVerification.value {
+			problems = append(problems, "TLS verification is skipped, not recommended outside of testing")
+		}
+	}
+
+	if len(problems) > 0 {
+		r.result(checkFail, "config", "invalid configuration", "correct the args in the kubeconfig exec stanza", problems...)
+		return
+	}
+	r.result(checkPass, "config", "configuration is valid", "")
+}
+
+// Check a cache file or directory is owned by the current user, not accessible to others
+// and not in a directory others could replace it in.
+func checkCacheFile(r *doctorReport, name, path string) {
+	if path == "" {
+		r.result(checkPass, name, "token caching is disabled", "")
+		return
+	}
+
+	problems, err := checkFileSecurity(path)
+	if os.IsNotExist(err) {
+		r.result(checkWarn, name, fmt.Sprintf("%s doesn't exist", path), "it will be created the next time a token is requested")
+		return
+	}
+	if err != nil {
+		r.result(checkFail, name, err.Error(), "")
+		return
+	}
+	if len(problems) == 0 {
+		r.result(checkPass, name, fmt.Sprintf("%s is owned by the current user and not accessible to others", path), "")
+		return
+	}
+
+	hint := fmt.Sprintf("remove %s, or set -token-path to a file in a directory only you can write to", path)
+	details := make([]string, 0, len(problems))
+	repairable := true
+	for _, p := range problems {
+		details = append(details, p.msg)
+		repairable = repairable && p.repairable
+	}
+	if repairable {
+		mode := "600"
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			mode = "700"
+		}
+		hint = fmt.Sprintf("chmod %s %s", mode, path)
+	}
+	r.result(checkFail, name, fmt.Sprintf("%s is insecure", path), hint, details...)
+}
+
+func checkEndpoints(r *doctorReport, kind string, urls []string, s tlsSettings) {
+	name := "token " + kind + " endpoint"
+
+	if len(s.caCerts) == 0 {
+		r.result(checkPass, name+" CA", "using the system certificate store", "")
+	} else if _, err := loadCertPool(s.caCerts); err != nil {
+		r.result(checkFail, name+" CA", err.Error(), "check the -ca-cert paths contain PEM encoded certificates")
+	} else {
+		r.result(checkPass, name+" CA", fmt.Sprintf("loaded %s", strings.Join(s.caCerts, ", ")), "")
+	}
+
+	tlsConfig, err := getTLSConfig(s)
+	if err != nil {
+		r.result(checkFail, name+" TLS", err.Error(), "check the TLS settings for the endpoint")
+		return
+	}
+
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil || parsed.Host == "" {
+			continue
+		}
+		checkConnection(r, name, parsed, tlsConfig)
+	}
+}
+
+// Resolve, connect and, for https endpoints, complete a TLS handshake with an endpoint.
+// Connections are made directly even if a proxy is configured.
+func checkConnection(r *doctorReport, name string, u *url.URL, tlsConfig *tls.Config) {
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		r.result(checkFail, name+" DNS", err.Error(), "check the endpoint host name, and that you're connected to the VPN if required")
+		return
+	}
+	r.result(checkPass, name+" DNS", fmt.Sprintf("%s resolves to %s", host, strings.Join(addrs, ", ")), "")
+
+	address := net.JoinHostPort(host, port)
+	conn, err := net.DialTimeout("tcp", address, cfg.connectTimeout)
+	if err != nil {
+		hint := "check the endpoint is reachable from this network"
+		if cfg.proxy != "" || getEnvAny("HTTPS_PROXY", "https_proxy") != "" {
+			hint += ", connections are tested directly so this may be expected when using a proxy"
+		}
+		r.result(checkFail, name+" TCP", err.Error(), hint)
+		return
+	}
+	defer conn.Close()
+	r.result(checkPass, name+" TCP", fmt.Sprintf("connected to %s", address), "")
+
+	if u.Scheme != "https" {
+		return
+	}
+
+	c := tlsConfig.Clone()
+	if c.ServerName == "" {
+		c.ServerName = host
+	}
+	tlsConn := tls.Client(conn, c)
+	tlsConn.SetDeadline(time.Now().Add(cfg.tlsHandshakeTimeout))
+	if err = tlsConn.Handshake(); err != nil {
+		r.result(checkFail, name+" TLS", err.Error(), "check -ca-cert, -server-name and -pin-sha256 match the certificate presented by the endpoint")
+		return
+	}
+
+	status, hint := checkPass, ""
+	var details []string
+	for _, cert := range tlsConn.ConnectionState().PeerCertificates {
+		details = append(details, describeCertificate(cert))
+		if time.Until(cert.NotAfter) < certExpiryWarning {
+			status, hint = checkWarn, "a certificate in the chain expires soon"
+		}
+	}
+	r.result(status, name+" TLS", fmt.Sprintf("handshake with %s succeeded", address), hint, details...)
+}
+
+func describeCertificate(cert *x509.Certificate) string {
+	return fmt.Sprintf("subject=%q issuer=%q expires=%s pin=%s%s",
+		cert.Subject.CommonName, cert.Issuer.CommonName, cert.NotAfter.Format(time.RFC3339), pinPrefix, spkiHash(cert))
+}
+
+func checkCachedToken(r *doctorReport, logger *leveledLogger) {
+	name := "cached token"
+	token, err := readCachedToken(cfg.tokenPath, logger)
+	if err != nil {
+		r.result(checkWarn, name, fmt.Sprintf("no usable cached token: %s", err), "run kubectl to log in")
+		return
+	}
+	logger.addSecret(string(token))
+
+	_, reviewClient, err := getHTTPClients(logger)
+	if err != nil {
+		r.result(checkFail, name, err.Error(), "")
+		return
+	}
+	tokenResponse, err := reviewToken(reviewClient, token)
+	if err != nil {
+		r.result(checkFail, name, fmt.Sprintf("review failed: %s", err), "check the token review endpoint checks above")
+		return
+	}
+	if !tokenResponse.Status.Authenticated {
+		r.result(checkWarn, name, "cached token is not authenticated", "run kubectl to log in again")
+		return
+	}
+
+	message := fmt.Sprintf("authenticated as %s", tokenResponse.Status.User.Username)
+	if expiry, ok := tokencache.Expiry(token); ok {
+		message += fmt.Sprintf(", expires %s", expiry.Format(time.RFC3339))
+	}
+	r.result(checkPass, name, message, "")
+}
+
+func checkKubeconfig(r *doctorReport) {
+	name := "kubeconfig"
+	path, err := kubeconfigPath()
+	if err != nil {
+		r.result(checkFail, name, err.Error(), "")
+		return
+	}
+
+	stanzas, err := readExecStanzas(path)
+	if err != nil {
+		r.result(checkFail, name, err.Error(), "set KUBECONFIG to the kubeconfig file in use")
+		return
+	}
+
+	self := filepath.Base(os.Args[0])
+	found := false
+	for _, s := range stanzas {
+		base := filepath.Base(s.command)
+		if base != self && !strings.Contains(base, "token-cache-plugin") {
+			continue
+		}
+		found = true
+		stanza := fmt.Sprintf("%s line %d", path, s.line)
+
+		if !supportedExecAPIVersions[s.apiVersion] {
+			r.result(checkFail, name, fmt.Sprintf("%s has unsupported apiVersion %q", stanza, s.apiVersion), `set apiVersion to "client.authentication.k8s.io/v1alpha1"`)
+			continue
+		}
+		if _, err := exec.LookPath(s.command); err != nil {
+			r.result(checkFail, name, fmt.Sprintf("%s command %q not found", stanza, s.command), "use an absolute path or add the plugin's directory to PATH")
+			continue
+		}
+		r.result(checkPass, name, fmt.Sprintf("%s exec stanza is valid", stanza), "")
+	}
+
+	if !found {
+		r.result(checkWarn, name, fmt.Sprintf("no exec stanza using %s found in %s", self, path), "see the README for an example exec stanza")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckConfig(t *testing.T) {
+	defer func() { cfg = config{} }()
+
+	cfg = config{
+		tokenRequestEndpoints: []string{"http://auth.example.com/ldapAuth"},
+		tokenReviewEndpoints:  []string{"auth.example.com"},
+		otpMode:               "sms",
+		revocationMethod:      revocationRFC7009,
+	}
+	var b bytes.Buffer
+	r := &doctorReport{w: &b}
+	checkConfig(r)
+
+	want := `[FAIL] config: invalid configuration
+       http://auth.example.com/ldapAuth doesn't use https, credentials and tokens would be sent in the clear
+       auth.example.com is not a valid URL
+       -otp-mode "sms" is not one of append or header
+       hint: correct the args in the kubeconfig exec stanza
+`
+	if b.String() != want {
+		t.Errorf("report = %q, want %q", b.String(), want)
+	}
+	if r.failures != 1 {
+		t.Errorf("failures = %d, want 1", r.failures)
+	}
+}
+
+func TestCheckEndpointsUnreachable(t *testing.T) {
+	defer func() { cfg = config{} }()
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy"} {
+		if v, ok := os.LookupEnv(name); ok {
+			defer os.Setenv(name, v)
+			os.Unsetenv(name)
+		}
+	}
+
+	// Listen then close to find a port nothing is listening on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	cfg = config{connectTimeout: time.Second}
+	var b bytes.Buffer
+	r := &doctorReport{w: &b}
+	checkEndpoints(r, reviewEndpoint, []string{"https://" + address + "/authenticate"}, tlsSettings{})
+
+	wantTCP := "[FAIL] token review endpoint TCP: "
+	wantHint := "\n       hint: check the endpoint is reachable from this network\n"
+	if !strings.Contains(b.String(), wantTCP) || !strings.HasSuffix(b.String(), wantHint) {
+		t.Errorf("report = %q, want %q with %q", b.String(), wantTCP, wantHint)
+	}
+	if r.failures != 1 {
+		t.Errorf("failures = %d, want 1", r.failures)
+	}
+}
+
+func TestCheckKubeconfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doctor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if v, ok := os.LookupEnv("KUBECONFIG"); ok {
+		defer os.Setenv("KUBECONFIG", v)
+	} else {
+		defer os.Unsetenv("KUBECONFIG")
+	}
+	self := filepath.Base(os.Args[0])
+
+	tests := []struct {
+		name       string
+		kubeconfig string
+		want       string
+	}{
+		{
+			name: "different binary",
+			kubeconfig: `users:
+- name: dev
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1alpha1
+      command: other-plugin
+`,
+			want: "[WARN] kubeconfig: no exec stanza using " + self + " found in %[1]s\n" +
+				"       hint: see the README for an example exec stanza\n",
+		},
+		{
+			name: "wrong apiVersion",
+			kubeconfig: `users:
+- name: dev
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1beta1
+      command: /usr/local/bin/token-cache-plugin
+`,
+			want: `[FAIL] kubeconfig: %[1]s line 4 has unsupported apiVersion "client.authentication.k8s.io/v1beta1"` + "\n" +
+				`       hint: set apiVersion to "client.authentication.k8s.io/v1alpha1"` + "\n",
+		},
+		{
+			name: "missing file",
+			want: "[FAIL] kubeconfig: open %[1]s: no such file or directory\n" +
+				"       hint: set KUBECONFIG to the kubeconfig file in use\n",
+		},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, fmt.Sprintf("config%d", i))
+			if test.kubeconfig != "" {
+				if err := ioutil.WriteFile(path, []byte(test.kubeconfig), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			os.Setenv("KUBECONFIG", path)
+
+			var b bytes.Buffer
+			checkKubeconfig(&doctorReport{w: &b})
+			if want := fmt.Sprintf(test.want, path); b.String() != want {
+				t.Errorf("report = %q, want %q", b.String(), want)
+			}
+		})
+	}
+}
+
+func TestReadExecStanzas(t *testing.T) {
+	f, err := ioutil.TempFile("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`apiVersion: v1
+users:
+- name: dev
+  user:
+    exec:
+      # The plugin
+      apiVersion: "client.authentication.k8s.io/v1alpha1"
+      command: token-cache-plugin  # on PATH
+      args:
+      - -v=1
+- name: other
+  user:
+    exec:
+      command: 'other-plugin'
+      apiVersion: client.authentication.k8s.io/v1beta1
+contexts: []
+`)
+	f.Close()
+
+	stanzas, err := readExecStanzas(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []execStanza{
+		{line: 5, command: "token-cache-plugin", apiVersion: "client.authentication.k8s.io/v1alpha1"},
+		{line: 13, command: "other-plugin", apiVersion: "client.authentication.k8s.io/v1beta1"},
+	}
+	if !reflect.DeepEqual(stanzas, want) {
+		t.Errorf("stanzas = %+v, want %+v", stanzas, want)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Signals the terminal sends to its whole foreground process group. The command run by exec
+// shares the plugin's process group so that it can read the terminal, so while the plugin is
+// in the foreground these already reach it and aren't forwarded, which would deliver them
+// twice. Otherwise, such as when sent with kill, they're forwarded.
+var terminalSignals = []os.Signal{os.Interrupt, syscall.SIGQUIT}
+
+// Whether terminal signals reach the command run by exec without being forwarded,
+// replaced in tests.
+var inForeground = terminalForeground
+
+// Signals forwarded to the command run by exec, so that it can clean up as it would if
+// run directly.
+var forwardedSignals = []os.Signal{syscall.SIGTERM, syscall.SIGHUP}
+
+// Acquire a token and run a command with it in its environment, exiting with the command's
+// exit code. Optionally the command is also given a temporary kubeconfig using the token.
+func execCommand(logger *leveledLogger, args []string) {
+	if len(args) == 0 {
+		logger.Fatalf("Usage: exec -- <command> [args...]\n")
+	}
+
+	source, err := newTokenSource(logger)
+	if err != nil {
+		logger.Fatalf("Error %s\n", err)
+	}
+	token, _, err := source.token()
+	if err != nil {
+		logger.Fatalf("Error %s\n", err)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, stderr
+	cmd.Env = append(os.Environ(), cfg.execEnvVar+"="+string(token))
+
+	var tempKubeconfig string
+	if cfg.execKubeconfig {
+		if tempKubeconfig, err = writeTokenKubeconfig(token); err != nil {
+			logger.Fatalf("Error writing kubeconfig: %s\n", err)
+		}
+		cmd.Env = append(cmd.Env, "KUBECONFIG="+tempKubeconfig)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+	defer signal.Stop(signals)
+	// Terminal signals are caught, so that the plugin outlives the command and removes the
+	// kubeconfig, rather than ignored, as the command would inherit ignoring them.
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, terminalSignals...)
+	defer signal.Stop(interrupts)
+
+	if err = cmd.Start(); err != nil {
+		if tempKubeconfig != "" {
+			os.Remove(tempKubeconfig)
+		}
+		logger.Fatalf("Error running %s: %s\n", args[0], err)
+	}
+	var forwarding sync.WaitGroup
+	forwarding.Add(2)
+	go func() {
+		defer forwarding.Done()
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+	go func() {
+		defer forwarding.Done()
+		for sig := range interrupts {
+			if !inForeground() {
+				cmd.Process.Signal(sig)
+			}
+		}
+	}()
+
+	err = cmd.Wait()
+	signal.Stop(signals)
+	signal.Stop(interrupts)
+	close(signals)
+	close(interrupts)
+	forwarding.Wait()
+	code := exitCode(err)
+	if code < 0 {
+		logger.Errorf("Error running %s: %s\n", args[0], err)
+		code = 1
+	}
+	if tempKubeconfig != "" {
+		os.Remove(tempKubeconfig)
+	}
+	logger.exit(code)
+}
+
+// Exit code of a finished command, or -1 if it didn't run to completion.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				return 128 + int(status.Signal())
+			}
+			return status.ExitStatus()
+		}
+	}
+	return -1
+}
+
+// Write a kubeconfig for the current context's cluster that authenticates with the token.
+// It's readable only by the current user and removed once the command exits.
+func writeTokenKubeconfig(token []byte) (string, error) {
+	cluster, err := currentCluster()
+	if err != nil {
+		return "", err
+	}
+
+	kc := kubeconfig{
+		APIVersion:     "v1",
+		Kind:           "Config",
+		CurrentContext: "token-cache-plugin",
+		Clusters:       []namedCluster{{Name: "token-cache-plugin", Cluster: cluster}},
+		Contexts: []namedContext{{Name: "token-cache-plugin", Context: kubeContext{
+			Cluster: "token-cache-plugin",
+			User:    "token-cache-plugin",
+		}}},
+		Users: []namedUser{{Name: "token-cache-plugin", User: kubeUser{Token: string(token)}}},
+	}
+
+	b, err := json.Marshal(kc)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile("", "token-cache-plugin-kubeconfig")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err = f.Chmod(os.FileMode(0600)); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if _, err = f.Write(b); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
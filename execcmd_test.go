@@ -0,0 +1,98 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mweigel/token-cache-plugin/devserver"
+)
+
+// Environment variable holding the file a command run by exec, run as the test binary,
+// reports the signals it receives to.
+const signalRecorderEnv = "TOKEN_CACHE_PLUGIN_SIGNAL_RECORDER"
+
+// The test binary doubles as a command recording signals, see TestExecSignals.
+func init() {
+	if path, ok := os.LookupEnv(signalRecorderEnv); ok {
+		recordSignals(path)
+		os.Exit(0)
+	}
+}
+
+// Count interrupts until terminated, writing ready to path once signals are handled and
+// the number of interrupts when terminated.
+func recordSignals(path string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	ioutil.WriteFile(path, []byte("ready"), 0600)
+	interrupts := 0
+	for sig := range signals {
+		if sig == syscall.SIGTERM {
+			ioutil.WriteFile(path, []byte(fmt.Sprintf("interrupts=%d", interrupts)), 0600)
+			return
+		}
+		interrupts++
+	}
+}
+
+func TestExecSignals(t *testing.T) {
+	defer func() { inForeground = terminalForeground }()
+
+	tests := []struct {
+		name       string
+		foreground bool
+		want       string
+	}{
+		// An interrupt sent to the plugin alone isn't forwarded while it's in the
+		// foreground, as Ctrl-C at the terminal reaches the command directly.
+		{"foreground", true, "interrupts=0"},
+		// In the background an interrupt can only have been sent to the plugin, with kill.
+		{"background", false, "interrupts=1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inForeground = func() bool { return test.foreground }
+			e := newTestEnv(t, devserver.Config{})
+			e.cache(e.issue())
+			path := filepath.Join(e.dir, "signals")
+			os.Setenv(signalRecorderEnv, path)
+			defer os.Unsetenv(signalRecorderEnv)
+
+			done := make(chan result)
+			go func() { done <- e.run("", "exec", "--", os.Args[0]) }()
+			waitForFile(t, path, "ready")
+
+			syscall.Kill(os.Getpid(), syscall.SIGINT)
+			time.Sleep(200 * time.Millisecond)
+			// Termination is always forwarded.
+			syscall.Kill(os.Getpid(), syscall.SIGTERM)
+
+			r := <-done
+			if r.code != 0 {
+				t.Fatalf("exit status %d, stderr:\n%s", r.code, r.stderr)
+			}
+			if b, _ := ioutil.ReadFile(path); string(b) != test.want {
+				t.Errorf("command recorded %q, want %s", b, test.want)
+			}
+		})
+	}
+}
+
+func waitForFile(t *testing.T, path, contents string) {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		if b, err := ioutil.ReadFile(path); err == nil && string(b) == contents {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", path)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/mweigel/token-cache-plugin/tokencache"
+)
+
+// Kinds of endpoint, used to key the last working endpoint of each.
+const (
+	requestEndpoint = tokencache.RequestEndpoint
+	reviewEndpoint  = tokencache.ReviewEndpoint
+)
+
+// File within the cache directory recording the last endpoint of each kind that responded.
+const lastEndpointsFile = "endpoints.json"
+
+// Send a request to each endpoint in turn until one responds without a server error.
+// Endpoints are tried starting from the last one to respond, which is then remembered in
+// the cache directory so that later invocations start from it. The response from the
+// final endpoint is returned as is, even if it's a server error, so callers can report it.
+func doWithFailover(client *http.Client, kind string, urls []string, newRequest func(url string) (*http.Request, error), idempotent bool) (*http.Response, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no token %s endpoint specified", kind)
+	}
+
+	ordered := orderEndpoints(kind, urls)
+	var lastErr error
+	for i, u := range ordered {
+		u := u
+		resp, err := doWithRetry(client, func() (*http.Request, error) {
+			return newRequest(u)
+		}, idempotent)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %s", u, err)
+			continue
+		}
+		if resp.StatusCode >= 500 && i < len(ordered)-1 {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("%s returned %s", u, resp.Status)
+			continue
+		}
+		if resp.StatusCode < 500 {
+			rememberEndpoint(kind, u)
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// Move the last endpoint to respond, if still configured, to the front.
+func orderEndpoints(kind string, urls []string) []string {
+	last := readLastEndpoints()[kind]
+	ordered := make([]string, 0, len(urls))
+	for _, u := range urls {
+		if u == last {
+			ordered = append([]string{u}, ordered...)
+			continue
+		}
+		ordered = append(ordered, u)
+	}
+	return ordered
+}
+
+func readLastEndpoints() map[string]string {
+	last := map[string]string{}
+	if cfg.cacheDir == "" {
+		return last
+	}
+	b, err := ioutil.ReadFile(filepath.Join(cfg.cacheDir, lastEndpointsFile))
+	if err != nil {
+		return last
+	}
+	json.Unmarshal(b, &last)
+	return last
+}
+
+// Remembering an endpoint is best effort, failing to do so only affects which endpoint
+// is tried first next time.
+func rememberEndpoint(kind, url string) {
+	last := readLastEndpoints()
+	if cfg.cacheDir == "" || last[kind] == url {
+		return
+	}
+	last[kind] = url
+
+	b, err := json.Marshal(last)
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(cfg.cacheDir, os.FileMode(0700)); err != nil {
+		return
+	}
+	writePrivateFile(filepath.Join(cfg.cacheDir, lastEndpointsFile), b)
+}
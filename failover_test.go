@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// Server answering with status, counting the requests it receives.
+func newStatusServer(t *testing.T, status int, hits *int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*hits++
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDoWithFailover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "failover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg = config{cacheDir: dir}
+	defer func() { cfg = config{} }()
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	var failingHits, workingHits int
+	failing := newStatusServer(t, http.StatusInternalServerError, &failingHits)
+	working := newStatusServer(t, http.StatusOK, &workingHits)
+	urls := []string{closed.URL, failing.URL, working.URL}
+
+	send := func() *http.Response {
+		resp, err := doWithFailover(http.DefaultClient, reviewEndpoint, urls, func(url string) (*http.Request, error) {
+			return http.NewRequest("POST", url, nil)
+		}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// A connection error and a 5xx move on to the next endpoint.
+	if resp := send(); resp.StatusCode != http.StatusOK || resp.Request.URL.Host != working.Listener.Addr().String() {
+		t.Fatalf("answered by %s with %d, want the working endpoint", resp.Request.URL, resp.StatusCode)
+	}
+	if failingHits != 1 || workingHits != 1 {
+		t.Errorf("hits = %d failing, %d working, want 1 each", failingHits, workingHits)
+	}
+
+	// The working endpoint is remembered and tried first next time.
+	if last := readLastEndpoints()[reviewEndpoint]; last != working.URL {
+		t.Errorf("endpoints.json records %q, want %q", last, working.URL)
+	}
+	send()
+	if failingHits != 1 || workingHits != 2 {
+		t.Errorf("hits = %d failing, %d working, want the working endpoint tried first", failingHits, workingHits)
+	}
+	if last := readLastEndpoints()[requestEndpoint]; last != "" {
+		t.Errorf("request endpoint recorded %q, want endpoints remembered per kind", last)
+	}
+}
+
+func TestDoWithFailoverClientError(t *testing.T) {
+	cfg = config{}
+	var rejectingHits, workingHits int
+	rejecting := newStatusServer(t, http.StatusUnauthorized, &rejectingHits)
+	working := newStatusServer(t, http.StatusOK, &workingHits)
+
+	resp, err := doWithFailover(http.DefaultClient, requestEndpoint, []string{rejecting.URL, working.URL}, func(url string) (*http.Request, error) {
+		return http.NewRequest("GET", url, nil)
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || workingHits != 0 {
+		t.Errorf("status %d with %d requests to the next endpoint, want the 401 without failing over", resp.StatusCode, workingHits)
+	}
+}
+
+func TestDoWithFailoverAllFail(t *testing.T) {
+	cfg = config{}
+	var hits int
+	failing := newStatusServer(t, http.StatusBadGateway, &hits)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	// The last endpoint's server error is returned so that it can be reported.
+	resp, err := doWithFailover(http.DefaultClient, reviewEndpoint, []string{closed.URL, failing.URL}, func(url string) (*http.Request, error) {
+		return http.NewRequest("POST", url, nil)
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status %d, want the last endpoint's 502", resp.StatusCode)
+	}
+
+	if _, err = doWithFailover(http.DefaultClient, reviewEndpoint, nil, nil, true); err == nil {
+		t.Error("no endpoints accepted")
+	}
+}
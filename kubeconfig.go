@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// API versions of ExecCredential the plugin can output.
+var supportedExecAPIVersions = map[string]bool{
+	"client.authentication.k8s.io/v1alpha1": true,
+}
+
+// Exec stanza for a credential plugin within a kubeconfig file.
+type execStanza struct {
+	line       int
+	command    string
+	apiVersion string
+}
+
+// Path of the kubeconfig file kubectl uses by default, the first in $KUBECONFIG or ~/.kube/config.
+func kubeconfigPath() (string, error) {
+	if env := os.Getenv("KUBECONFIG"); env != "" {
+		return filepath.SplitList(env)[0], nil
+	}
+	currentUser, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(currentUser.HomeDir, ".kube", "config"), nil
+}
+
+// Find exec stanzas within a kubeconfig file. Rather than pulling in a YAML parser the file
+// is scanned for exec keys and the command and apiVersion keys indented beneath them, which
+// covers kubeconfig files as written by kubectl and by hand.
+func readExecStanzas(path string) ([]execStanza, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var stanzas []execStanza
+	var current *execStanza
+	execIndent := 0
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+
+		if current != nil && indent <= execIndent {
+			stanzas = append(stanzas, *current)
+			current = nil
+		}
+		if trimmed == "exec:" {
+			current = &execStanza{line: n}
+			execIndent = indent
+			continue
+		}
+		if current == nil {
+			continue
+		}
+
+		key, value := yamlKeyValue(trimmed)
+		switch key {
+		case "command":
+			current.command = value
+		case "apiVersion":
+			current.apiVersion = value
+		}
+	}
+	if current != nil {
+		stanzas = append(stanzas, *current)
+	}
+	return stanzas, scanner.Err()
+}
+
+func yamlKeyValue(line string) (string, string) {
+	parts := strings.SplitN(line, ":", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	value := strings.TrimSpace(parts[1])
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return strings.TrimSpace(parts[0]), strings.Trim(value, `"'`)
+}
+
+// Cluster of the current kubeconfig context.
+type kubeCluster struct {
+	Server                   string `json:"server"`
+	CertificateAuthorityData []byte `json:"certificate-authority-data,omitempty"`
+	InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify,omitempty"`
+	TLSServerName            string `json:"tls-server-name,omitempty"`
+}
+
+// Minimal kubeconfig, as written by kubectl config view -o json and read by kubectl.
+type kubeconfig struct {
+	APIVersion     string         `json:"apiVersion"`
+	Kind           string         `json:"kind"`
+	CurrentContext string         `json:"current-context"`
+	Clusters       []namedCluster `json:"clusters"`
+	Contexts       []namedContext `json:"contexts"`
+	Users          []namedUser    `json:"users"`
+}
+
+type namedCluster struct {
+	Name    string      `json:"name"`
+	Cluster kubeCluster `json:"cluster"`
+}
+
+type namedContext struct {
+	Name    string      `json:"name"`
+	Context kubeContext `json:"context"`
+}
+
+type kubeContext struct {
+	Cluster   string `json:"cluster"`
+	User      string `json:"user"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+type namedUser struct {
+	Name string   `json:"name"`
+	User kubeUser `json:"user"`
+}
+
+type kubeUser struct {
+	Token string `json:"token,omitempty"`
+}
+
+// Find the API server of the current context. -api-server takes precedence, otherwise
+// kubectl resolves the kubeconfig, so that KUBECONFIG, merging and --context behave exactly
+// as they do for kubectl.
+func currentCluster() (kubeCluster, error) {
+	if cfg.apiServer != "" {
+		c := kubeCluster{Server: cfg.apiServer}
+		if cfg.apiServerCA != "" {
+			ca, err := ioutil.ReadFile(cfg.apiServerCA)
+			if err != nil {
+				return kubeCluster{}, err
+			}
+			c.CertificateAuthorityData = ca
+		}
+		return c, nil
+	}
+
+	args := []string{"config", "view", "--minify", "--flatten", "-o", "json"}
+	if cfg.kubeContext != "" {
+		args = append(args, "--context", cfg.kubeContext)
+	}
+	out, err := exec.Command("kubectl", args...).Output()
+	if err != nil {
+		return kubeCluster{}, fmt.Errorf("reading kubeconfig with kubectl: %s", err)
+	}
+
+	var kc kubeconfig
+	if err = json.Unmarshal(out, &kc); err != nil {
+		return kubeCluster{}, err
+	}
+	if len(kc.Clusters) == 0 || kc.Clusters[0].Cluster.Server == "" {
+		return kubeCluster{}, errors.New("no cluster found for the current kubeconfig context, set -api-server")
+	}
+	return kc.Clusters[0].Cluster, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mweigel/token-cache-plugin/tokencache"
+)
+
+type logLevel int
+
+// Log levels, each level includes those before it. Info is the default, debug and trace
+// are enabled by -v=1 and -v=2 respectively. Trace includes HTTP requests and responses.
+const (
+	levelError logLevel = iota
+	levelWarn
+	levelInfo
+	levelDebug
+	levelTrace
+)
+
+var levelNames = map[logLevel]string{
+	levelError: "error",
+	levelWarn:  "warn",
+	levelInfo:  "info",
+	levelDebug: "debug",
+	levelTrace: "trace",
+}
+
+// Environment variable setting the log level when -v isn't given.
+const logLevelEnv = "TOKEN_CACHE_PLUGIN_LOG_LEVEL"
+
+// Replacement for anything redacted from log lines.
+const redacted = "[REDACTED]"
+
+// Patterns which are always redacted, in case a secret reaches a log line before it's
+// been registered with the logger.
+var redactPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`(?i)(authorization:\s*)(?:(?:basic|bearer|digest|negotiate)\s+)?\S+`), "${1}" + redacted},
+	// Credentials in a header value position, such as Authorization="Bearer x", and not
+	// prose such as "basic auth failed".
+	{regexp.MustCompile(`(?im)((?:^|[:="'])\s*)(bearer|basic)\s+[A-Za-z0-9\-._~+/]+=*(["',;]|\s*$)`), "${1}${2} " + redacted + "${3}"},
+	{regexp.MustCompile(`(?i)("(?:token|password|otp)"\s*:\s*)"[^"]*"`), `$1"` + redacted + `"`},
+	{regexp.MustCompile(`(?i)\b((?:token|password|otp)=)[^&\s]+`), "${1}" + redacted},
+	{regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), redacted},
+}
+
+// Logger writing to stderr, as kubectl expects an ExecCredential on stdout, at a
+// configurable level as text or JSON lines. Every line is redacted of registered secrets
+// and anything resembling a token, password or Authorization header.
+type leveledLogger struct {
+	mu      sync.Mutex
+	out     io.Writer
+	level   logLevel
+	json    bool
+	secrets []string
+	exit    func(int)
+}
+
+func newLogger(out io.Writer, level logLevel, jsonFormat bool) *leveledLogger {
+	return &leveledLogger{out: out, level: level, json: jsonFormat, exit: os.Exit}
+}
+
+// Determine the log level from -v, falling back to TOKEN_CACHE_PLUGIN_LOG_LEVEL which
+// may be a level name or a verbosity number.
+func configuredLogLevel() (logLevel, error) {
+	if cfg.verbosity > 0 {
+		return verbosityLevel(cfg.verbosity), nil
+	}
+	env := os.Getenv(logLevelEnv)
+	if env == "" {
+		return levelInfo, nil
+	}
+	if v, err := strconv.Atoi(env); err == nil {
+		return verbosityLevel(v), nil
+	}
+	for level, name := range levelNames {
+		if strings.EqualFold(env, name) {
+			return level, nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown %s %q", logLevelEnv, env)
+}
+
+func verbosityLevel(v int) logLevel {
+	level := levelInfo + logLevel(v)
+	if level > levelTrace {
+		level = levelTrace
+	}
+	return level
+}
+
+// Register a secret, such as a token or password, which must never appear in a log line.
+func (l *leveledLogger) addSecret(secret string) {
+	secret = strings.TrimSpace(secret)
+	if secret == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.secrets = append(l.secrets, secret)
+	// Replace longer secrets first so that a secret containing another is fully redacted.
+	sort.Slice(l.secrets, func(i, j int) bool { return len(l.secrets[i]) > len(l.secrets[j]) })
+}
+
+func (l *leveledLogger) enabled(level logLevel) bool {
+	return level <= l.level
+}
+
+func (l *leveledLogger) Errorf(format string, args ...interface{}) {
+	l.logf(levelError, format, args...)
+}
+
+func (l *leveledLogger) Warnf(format string, args ...interface{}) {
+	l.logf(levelWarn, format, args...)
+}
+
+func (l *leveledLogger) Infof(format string, args ...interface{}) {
+	l.logf(levelInfo, format, args...)
+}
+
+func (l *leveledLogger) Debugf(format string, args ...interface{}) {
+	l.logf(levelDebug, format, args...)
+}
+
+func (l *leveledLogger) Tracef(format string, args ...interface{}) {
+	l.logf(levelTrace, format, args...)
+}
+
+// Log an error and exit.
+func (l *leveledLogger) Fatalf(format string, args ...interface{}) {
+	l.logf(levelError, format, args...)
+	l.exit(1)
+}
+
+func (l *leveledLogger) logf(level logLevel, format string, args ...interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	msg := l.redact(strings.TrimRight(fmt.Sprintf(format, args...), "\n"))
+	if !l.json {
+		fmt.Fprintln(l.out, msg)
+		return
+	}
+
+	line, err := json.Marshal(struct {
+		Time  string `json:"time"`
+		Level string `json:"level"`
+		Msg   string `json:"msg"`
+	}{time.Now().UTC().Format(time.RFC3339Nano), levelNames[level], msg})
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(l.out, "%s\n", line)
+}
+
+func (l *leveledLogger) redact(msg string) string {
+	for _, s := range l.secrets {
+		msg = strings.Replace(msg, s, redacted, -1)
+	}
+	for _, p := range redactPatterns {
+		msg = p.re.ReplaceAllString(msg, p.repl)
+	}
+	return msg
+}
+
+// Headers whose values are never logged.
+var sensitiveHeaders = map[string]bool{
+	"Authorization":                    true,
+	"Proxy-Authorization":              true,
+	"Cookie":                           true,
+	"Set-Cookie":                       true,
+	tokencache.ChallengeResponseHeader: true,
+}
+
+// Transport logging requests and responses at trace level. Bodies aren't logged as they
+// contain tokens that may not have been registered as secrets yet.
+type tracingTransport struct {
+	next   http.RoundTripper
+	logger *leveledLogger
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.logger.Tracef("HTTP request: %s %s %s", req.Method, req.URL, formatHeaders(req.Header))
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.logger.Tracef("HTTP error: %s %s after %s: %s", req.Method, req.URL, time.Since(start), err)
+		return resp, err
+	}
+
+	t.logger.Tracef("HTTP response: %s %s %s after %s, %d byte body %s",
+		req.Method, req.URL, resp.Status, time.Since(start), resp.ContentLength, formatHeaders(resp.Header))
+	return resp, nil
+}
+
+func formatHeaders(h http.Header) string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := strings.Join(h[k], ", ")
+		if sensitiveHeaders[http.CanonicalHeaderKey(k)] || (cfg.otpMode == otpModeHeader && strings.EqualFold(k, cfg.otpHeader)) {
+			v = redacted
+		}
+		parts = append(parts, fmt.Sprintf("%s=%q", k, v))
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mweigel/token-cache-plugin/devserver"
+)
+
+func TestTraceRedaction(t *testing.T) {
+	for _, format := range []string{"text", "json"} {
+		t.Run(format, func(t *testing.T) {
+			e := newTestEnv(t, devserver.Config{})
+			issuer := e.server.Config.Handler
+			e.server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.SetCookie(w, &http.Cookie{Name: "session", Value: "cookie-secret"})
+				issuer.ServeHTTP(w, r)
+			})
+
+			r := e.run("jdoe\nsecret\n654321\n", "-v=2", "-log-format="+format, "-otp-mode=header")
+			token := r.token(t)
+			if !strings.Contains(r.stderr, "HTTP response") {
+				t.Fatalf("stderr = %q, want HTTP requests traced", r.stderr)
+			}
+			// amRvZTpzZWNyZXQ= is the basic auth value of jdoe:secret.
+			for _, secret := range []string{"secret", "654321", "amRvZTpzZWNyZXQ=", "cookie-secret", token} {
+				if strings.Contains(r.stderr, secret) {
+					t.Errorf("stderr contains %q:\n%s", secret, r.stderr)
+				}
+			}
+
+			// Bearer tokens sent to the API server are traced too.
+			var b bytes.Buffer
+			logger := newLogger(&b, levelTrace, format == "json")
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			defer server.Close()
+			req, err := http.NewRequest("GET", server.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := (&tracingTransport{next: http.DefaultTransport, logger: logger}).RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if !strings.Contains(b.String(), "Authorization") || strings.Contains(b.String(), token) {
+				t.Errorf("trace = %q, want the Authorization header redacted", b.String())
+			}
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{"Authorization: Bearer abc.def", "Authorization: [REDACTED]"},
+		{`header [Proxy="Basic amRvZTpzZWNyZXQ="]`, `header [Proxy="Basic [REDACTED]"]`},
+		{"Bearer abc123", "Bearer [REDACTED]"},
+		{`{"token": "abc123"}`, `{"token": "[REDACTED]"}`},
+		{"POST /login?password=hunter2&user=jdoe", "POST /login?password=[REDACTED]&user=jdoe"},
+		{"token eyJhbGciOiJub25lIn0.eyJzdWIiOiJqZG9lIn0.", "token [REDACTED]"},
+		{"Token request endpoint doesn't accept basic auth, retrying", "Token request endpoint doesn't accept basic auth, retrying"},
+		{"the bearer token has expired", "the bearer token has expired"},
+	}
+	logger := newLogger(&bytes.Buffer{}, levelInfo, false)
+	for _, test := range tests {
+		if got := logger.redact(test.msg); got != test.want {
+			t.Errorf("redact(%q) = %q, want %q", test.msg, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/mweigel/token-cache-plugin/tokencache"
+)
+
+// Ways a token can be revoked.
+const (
+	// OAuth 2.0 token revocation, the token is posted as a form.
+	// https://tools.ietf.org/html/rfc7009
+	revocationRFC7009 = "rfc7009"
+	// DELETE request to the revocation endpoint authenticated with the token itself.
+	revocationDelete = "delete"
+)
+
+// Revoke the cached token, if a revocation endpoint is configured, then remove it from
+// the cache. The token is removed even if revocation fails.
+func logout(logger *leveledLogger) {
+	found, revokeErr, err := removeCachedToken(logger)
+	switch {
+	case err != nil:
+		logger.Fatalf("Error %s\n", err)
+	case !found:
+		logger.Infof("No cached token to log out\n")
+	case cfg.revocationEndpoint == "":
+		logger.Infof("Removed cached token, no revocation endpoint is configured so it remains valid until it expires\n")
+	case revokeErr != nil:
+		logger.Fatalf("Removed cached token but revocation failed, it remains valid until it expires: %s\n", revokeErr)
+	default:
+		logger.Infof("Revoked and removed cached token\n")
+	}
+}
+
+// Revoke, if configured, and remove the cached token. Reports whether there was a cached
+// token and, separately, any error revoking it.
+func removeCachedToken(logger *leveledLogger) (found bool, revokeErr error, err error) {
+	token, err := readCachedToken(cfg.tokenPath, logger)
+	if os.IsNotExist(err) {
+		return false, nil, nil
+	}
+	if err != nil {
+		return false, nil, fmt.Errorf("reading cached token: %s", err)
+	}
+	logger.addSecret(string(token))
+
+	if cfg.revocationEndpoint != "" {
+		client, err := getHTTPClient(cfg.requestTLS.merge(cfg.tls), logger)
+		if err != nil {
+			return true, nil, fmt.Errorf("creating HTTP client: %s", err)
+		}
+		revokeErr = revokeToken(client, token)
+	}
+
+	if err = os.Remove(cfg.tokenPath); err != nil {
+		return true, revokeErr, fmt.Errorf("removing cached token: %s", err)
+	}
+	if index, err := localCache().ReadIndex(); err == nil {
+		localCache().Remove(index, tokencache.Key(cfg.tokenPath))
+	}
+	forgetReview(token)
+	return true, revokeErr, nil
+}
+
+func revokeToken(client *http.Client, token []byte) error {
+	var newRequest func() (*http.Request, error)
+	switch cfg.revocationMethod {
+	case revocationRFC7009:
+		form := url.Values{
+			"token":           {string(token)},
+			"token_type_hint": {"access_token"},
+		}.Encode()
+		newRequest = func() (*http.Request, error) {
+			req, err := http.NewRequest("POST", cfg.revocationEndpoint, strings.NewReader(form))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return req, nil
+		}
+	case revocationDelete:
+		newRequest = func() (*http.Request, error) {
+			req, err := http.NewRequest("DELETE", cfg.revocationEndpoint, nil)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Authorization", "Bearer "+string(token))
+			return req, nil
+		}
+	default:
+		return fmt.Errorf("unknown revocation-method %q", cfg.revocationMethod)
+	}
+
+	// Revoking a token more than once has no further effect so it's safe to retry.
+	resp, err := doWithRetry(client, newRequest, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("revocation endpoint returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mweigel/token-cache-plugin/devserver"
+	"github.com/mweigel/token-cache-plugin/tokencache"
+)
+
+// Whether the token service still authenticates a token.
+func (e *testEnv) authenticated(token string) bool {
+	body, err := json.Marshal(tokencache.NewTokenReviewRequest([]byte(token)))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	resp, err := e.server.Client().Post(e.server.URL+devserver.ReviewPath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var res tokencache.TokenReviewResponse
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		e.t.Fatal(err)
+	}
+	return res.Status.Authenticated
+}
+
+func TestLogout(t *testing.T) {
+	for _, method := range []string{revocationRFC7009, revocationDelete} {
+		t.Run(method, func(t *testing.T) {
+			e := newTestEnv(t, devserver.Config{})
+			token := e.issue()
+			e.cache(token)
+
+			r := e.run("", "logout", "-revocation-endpoint="+e.server.URL+devserver.RevocationPath, "-revocation-method="+method)
+			if r.code != 0 {
+				t.Fatalf("exit status %d, stderr:\n%s", r.code, r.stderr)
+			}
+			if !strings.Contains(r.stderr, "Revoked and removed cached token") {
+				t.Errorf("stderr = %q, want the token revoked", r.stderr)
+			}
+			if e.authenticated(token) {
+				t.Error("token still authenticated after logout")
+			}
+			if _, err := os.Stat(filepath.Join(e.dir, "token")); !os.IsNotExist(err) {
+				t.Errorf("cached token not removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestLogoutRevocationFails(t *testing.T) {
+	e := newTestEnv(t, devserver.Config{})
+	token := e.issue()
+	e.cache(token)
+
+	r := e.run("", "logout", "-revocation-endpoint="+e.server.URL+"/missing")
+	if r.code == 0 {
+		t.Error("logout succeeded although revocation failed")
+	}
+	if !strings.Contains(r.stderr, "revocation failed") || !strings.Contains(r.stderr, "404") {
+		t.Errorf("stderr = %q, want the failed revocation reported", r.stderr)
+	}
+	if _, err := os.Stat(filepath.Join(e.dir, "token")); !os.IsNotExist(err) {
+		t.Errorf("cached token not removed after failed revocation: %v", err)
+	}
+	if !e.authenticated(token) {
+		t.Error("token revoked by a failed revocation")
+	}
+}
+
+func TestLogoutWithoutRevocation(t *testing.T) {
+	e := newTestEnv(t, devserver.Config{})
+	e.cache(e.issue())
+
+	r := e.run("", "logout")
+	if r.code != 0 || !strings.Contains(r.stderr, "remains valid until it expires") {
+		t.Errorf("exit status %d, stderr %q, want the token removed but not revoked", r.code, r.stderr)
+	}
+}
+
+func TestLogoutNoCachedToken(t *testing.T) {
+	e := newTestEnv(t, devserver.Config{})
+
+	r := e.run("", "logout", "-revocation-endpoint="+e.server.URL+devserver.RevocationPath)
+	if r.code != 0 {
+		t.Fatalf("exit status %d, stderr:\n%s", r.code, r.stderr)
+	}
+	if !strings.Contains(r.stderr, "No cached token to log out") {
+		t.Errorf("stderr = %q, want no cached token reported", r.stderr)
+	}
+}
@@ -1,178 +1,279 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
 	"net/http"
 	"os"
 	"os/user"
 	"path/filepath"
-	"syscall"
+	"time"
 
-	"golang.org/x/crypto/ssh/terminal"
+	"github.com/mweigel/token-cache-plugin/tokencache"
 )
 
 var cfg = config{}
 
-func init() {
-	flag.StringVar(&cfg.tokenRequestEndpoint, "token-request-endpoint", "", "URL of endpoint responsible for issuing tokens")
-	flag.StringVar(&cfg.tokenReviewEndpoint, "token-review-endpoint", "", "URL of endpoint responsible for reviewing tokens")
-	flag.StringVar(&cfg.caCert, "ca-cert", "", "Path to CA certificate used to verify token request and review endpoints")
-	flag.StringVar(&cfg.tokenPath, "token-path", "", "Fully qualified path to save and load locally cached tokens")
-	flag.BoolVar(&cfg.skipTLSVerification, "skip-tls-verification", false, "Skip TLS verification of token request and review endpoint certificates")
-	flag.BoolVar(&cfg.cacheTokens, "cache-tokens", true, "Whether to cache tokens returned by the token request endpoint locally")
+// Register flags, populated by arguments from the kubeconfig file, on a flag set.
+func registerFlags(fs *flag.FlagSet, c *config) {
+	fs.Var(&c.tokenRequestEndpoints, "token-request-endpoint", "URL of endpoint responsible for issuing tokens, may be repeated to fail over between endpoints")
+	fs.Var(&c.tokenReviewEndpoints, "token-review-endpoint", "URL of endpoint responsible for reviewing tokens, may be repeated to fail over between endpoints")
+	registerTLSFlags(fs, &c.tls, "", "token request and review endpoints")
+	registerTLSFlags(fs, &c.requestTLS, "request-", "the token request endpoint")
+	registerTLSFlags(fs, &c.reviewTLS, "review-", "the token review endpoint")
+	fs.StringVar(&c.proxy, "proxy", "", "URL of proxy used to reach token endpoints, defaults to HTTPS_PROXY or HTTP_PROXY")
+	fs.StringVar(&c.noProxy, "no-proxy", "", "Comma separated hosts, domains and CIDR ranges to connect to without -proxy, defaults to NO_PROXY")
+	fs.DurationVar(&c.connectTimeout, "connect-timeout", 10*time.Second, "Maximum time to wait for a connection to a token endpoint")
+	fs.DurationVar(&c.tlsHandshakeTimeout, "tls-handshake-timeout", 10*time.Second, "Maximum time to wait for a TLS handshake with a token endpoint")
+	fs.DurationVar(&c.timeout, "timeout", 30*time.Second, "Maximum time for a single request to a token endpoint, including reading the response")
+	fs.IntVar(&c.maxRetries, "max-retries", 3, "Maximum number of times to retry a failed request to a token endpoint")
+	fs.DurationVar(&c.retryDelay, "retry-delay", 500*time.Millisecond, "Initial delay between retries, doubled on each attempt")
+	fs.DurationVar(&c.retryMaxDelay, "retry-max-delay", 10*time.Second, "Maximum delay between retries, including delays requested with Retry-After")
+	fs.StringVar(&c.tokenPath, "token-path", "", "Fully qualified path to save and load locally cached tokens")
+	fs.StringVar(&c.strictModes, "strict-modes", strictModesRepair, "How cache files accessible to others are handled, one of repair, refuse or off")
+	fs.DurationVar(&c.offlineGrace, "offline-grace", time.Hour, "How long after it was last reviewed a cached token is used if the token review endpoint is unreachable, 0 to disable")
+	fs.IntVar(&c.maxLoginFailures, "max-login-failures", 3, "Consecutive failed logins after which logins are refused without prompting for a password, 0 to disable throttling")
+	fs.DurationVar(&c.loginFailureWindow, "login-failure-window", 30*time.Minute, "How long failed logins are remembered for throttling")
+	fs.DurationVar(&c.reviewCacheTTL, "review-cache-ttl", 0, "How long a token authenticated by the token review endpoint is trusted without reviewing it again, 0 to disable")
+	fs.DurationVar(&c.reviewCacheNegativeTTL, "review-cache-negative-ttl", 0, "How long a token rejected by the token review endpoint is remembered as rejected, 0 to disable")
+	fs.StringVar(&c.cacheDir, "cache-dir", "", "Directory used to store plugin state such as the last working endpoints, defaults to ~/.k8s-token-cache")
+	fs.BoolVar(&c.clientCertOnly, "client-cert-only", false, "Authenticate token requests with the client certificate alone, without prompting for credentials")
+	fs.BoolVar(&c.cacheTokens, "cache-tokens", true, "Whether to cache tokens returned by the token request endpoint locally")
+	fs.StringVar(&c.username, "username", "", "Username to authenticate with, only the password is prompted for if set")
+	fs.BoolVar(&c.useOSUsername, "use-os-username", false, "Use $USER as the username if -username is not set")
+	fs.StringVar(&c.otpMode, "otp-mode", "", "How to send a one time password to the token request endpoint, either append or header")
+	fs.StringVar(&c.otpHeader, "otp-header", "X-OTP", "Header used to send the one time password when otp-mode is header")
+	fs.StringVar(&c.totpSecretFile, "totp-secret-file", "", "Path to a base32 TOTP seed used to generate one time passwords instead of prompting")
+	fs.BoolVar(&c.challengeResponse, "challenge-response", false, "Answer challenges returned by the token request endpoint with a 401")
+	fs.StringVar(&c.revocationEndpoint, "revocation-endpoint", "", "URL of endpoint used to revoke tokens on logout")
+	fs.StringVar(&c.revocationMethod, "revocation-method", revocationRFC7009, "How tokens are revoked, either rfc7009 or delete")
+	fs.StringVar(&c.format, "format", formatTable, "Format used by whoami, one of table, json or yaml")
+	fs.IntVar(&c.verbosity, "v", 0, "Log verbosity, 1 for debug and 2 to also trace HTTP requests, defaults to $TOKEN_CACHE_PLUGIN_LOG_LEVEL")
+	fs.StringVar(&c.logFormat, "log-format", "text", "Format of log messages written to stderr, either text or json")
+	fs.StringVar(&c.auditLog, "audit-log", "", "Path of a JSON lines audit log recording token reviews, requests and cache use")
+	fs.Int64Var(&c.auditLogMaxSize, "audit-log-max-size", 10*1024*1024, "Size in bytes at which the audit log is rotated")
+	fs.IntVar(&c.auditLogMaxBackups, "audit-log-max-backups", 5, "Number of rotated audit logs to keep")
+	fs.Var(&c.dockerRegistries, "docker-registry", "Registry the Docker credential helper hands out tokens for, may be repeated, defaults to any registry")
+	fs.StringVar(&c.output, "output", outputExecCredential, "Format the token is written to stdout in, one of execcredential, token, header, bash, fish, json or curl")
+	fs.StringVar(&c.outputEnvVar, "output-env-var", "K8S_TOKEN", "Environment variable set by the bash and fish outputs")
+	fs.StringVar(&c.execEnvVar, "exec-env-var", "K8S_TOKEN", "Environment variable holding the token for commands run by exec")
+	fs.BoolVar(&c.execKubeconfig, "exec-kubeconfig", false, "Give commands run by exec a temporary kubeconfig using the token")
+	fs.StringVar(&c.apiServer, "api-server", "", "URL of the API server, defaults to the server of the current kubeconfig context")
+	fs.StringVar(&c.apiServerCA, "api-server-ca", "", "Path to the CA certificate of -api-server")
+	fs.StringVar(&c.kubeContext, "context", "", "Kubeconfig context used to find the API server, defaults to the current context")
+	fs.StringVar(&c.listen, "listen", "127.0.0.1:8001", "Address the proxy command listens on, or unix:<path> for a Unix socket")
+	fs.StringVar(&c.acceptHosts, "accept-hosts", "localhost,127.0.0.1,[::1]", "Comma separated hosts the proxy command accepts requests for, others are refused")
+	fs.StringVar(&c.devUsers, "dev-users", "", "Path to the users file of the serve-dev token service, with lines of name:password[:groups]")
+	fs.DurationVar(&c.devTokenTTL, "dev-token-ttl", time.Hour, "Lifetime of tokens issued by serve-dev, 0 for tokens that never expire")
+	fs.DurationVar(&c.devLatency, "dev-latency", 0, "Delay added by serve-dev before every response")
+	fs.Float64Var(&c.devErrorRate, "dev-error-rate", 0, "Fraction of serve-dev requests, between 0 and 1, failed with -dev-error-status")
+	fs.IntVar(&c.devErrorStatus, "dev-error-status", 500, "HTTP status of errors injected by serve-dev")
+	fs.Float64Var(&c.devMalformedRate, "dev-malformed-rate", 0, "Fraction of serve-dev token reviews, between 0 and 1, answered with a malformed response")
+	fs.StringVar(&c.devTLSCert, "dev-tls-cert", "", "Path to the PEM encoded certificate served by serve-dev, which serves plain HTTP if unset")
+	fs.StringVar(&c.devTLSKey, "dev-tls-key", "", "Path to the PEM encoded private key for -dev-tls-cert")
+	fs.StringVar(&c.pinentry, "pinentry", "", "Path to a pinentry program used to prompt for the password instead of the terminal")
 }
 
+// Standard streams, replaced by tests through run.
+var (
+	stdin  io.Reader = os.Stdin
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+)
+
+// Exit status of a run ended early by logger.Fatalf.
+type exitStatus int
+
 func main() {
-	flag.Parse()
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
 
-	// Log messages must be written to stderr as kubectl is expecting execCredential on stdout.
-	logger := log.New(os.Stderr, "", 0)
+// Run the plugin with the given arguments and standard streams, returning its exit status.
+func run(arguments []string, in io.Reader, out, errOut io.Writer) (code int) {
+	stdin, stdout, stderr = in, out, errOut
+	cfg, auditLog = config{}, nil
+	loadedCertificates = map[string]*tls.Certificate{}
+	fs := flag.NewFlagSet("token-cache-plugin", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	registerFlags(fs, &cfg)
 
-	// If a path to a token file is not specified and caching is requested set a default.
-	if cfg.tokenPath == "" && cfg.cacheTokens {
-		currentUser, err := user.Current()
+	if isDockerCredentialHelper() {
+		flags, err := readDockerCredentialFlags()
 		if err != nil {
-			logger.Fatalf("Error setting token-path: %s\n", err)
+			fmt.Fprintf(stderr, "Error reading docker credential helper flags: %s\n", err)
+			return 1
 		}
-		cfg.tokenPath = filepath.Join(currentUser.HomeDir, ".k8s-last-token")
+		arguments = append(append(flags, "docker-credential"), arguments...)
 	}
-
-	client, err := getHTTPClient()
-	if err != nil {
-		logger.Fatalf("Error creating HTTP client: %s\n", err)
+	args, err := parseArgs(fs, arguments)
+	if err == flag.ErrHelp {
+		return 0
 	}
-
-	// Attempt to read and use a previously cached token before prompting for a username and password.
-	token, err := ioutil.ReadFile(cfg.tokenPath)
 	if err != nil {
-		logger.Println(err)
+		return 2
 	}
-
-	tokenResponse, err := reviewToken(client, token)
-	if err != nil {
-		logger.Println(err)
+	command := ""
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
 	}
-	if !tokenResponse.Status.Authenticated {
-		var username, password string
-		if err = readCredentials(&username, &password); err != nil {
-			logger.Fatalf("Error reading credentials: %s\n", err)
-		}
-		if token, err = requestToken(client, username, password); err != nil {
-			logger.Fatalf("Error requesting token: %s\n", err)
-		}
 
-		// Write token to file to be used next time kubectl is run unless caching is disabled.
-		if cfg.cacheTokens {
-			if err = ioutil.WriteFile(cfg.tokenPath, token, os.FileMode(0600)); err != nil {
-				logger.Println(err)
+	// Log messages must be written to stderr as kubectl is expecting execCredential on stdout.
+	level, err := configuredLogLevel()
+	logger := newLogger(stderr, level, cfg.logFormat == "json")
+	logger.exit = func(code int) {
+		panic(exitStatus(code))
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			status, ok := r.(exitStatus)
+			if !ok {
+				panic(r)
 			}
+			code = int(status)
 		}
+	}()
+	if err != nil {
+		logger.Warnf("%s, using info\n", err)
 	}
-
-	// Write token to stdout to be used by kubectl.
-	if err = outputToken(token); err != nil {
-		logger.Fatalf("Unable to output token: %s\n", err)
+	if cfg.logFormat != "text" && cfg.logFormat != "json" {
+		logger.Warnf("Unknown log-format %q, using text\n", cfg.logFormat)
 	}
-}
 
-// Review token using the same endpoint that K8s will also use.
-// https://kubernetes.io/docs/admin/authentication/#webhook-token-authentication
-func reviewToken(client *http.Client, token []byte) (tokenReviewResponse, error) {
-	postBody, err := json.Marshal(newTokenReviewRequest(token))
-	if err != nil {
-		return tokenReviewResponse{}, err
+	// If a path to a token file is not specified and caching is requested set a default.
+	if cfg.tokenPath == "" && cfg.cacheTokens {
+		currentUser, err := user.Current()
+		if err != nil {
+			logger.Fatalf("Error setting token-path: %s\n", err)
+		}
+		cfg.tokenPath = filepath.Join(currentUser.HomeDir, ".k8s-last-token")
 	}
 
-	req, err := http.NewRequest("POST", cfg.tokenReviewEndpoint, bytes.NewReader(postBody))
-	if err != nil {
-		return tokenReviewResponse{}, err
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		return tokenReviewResponse{}, err
+	if cfg.cacheDir == "" {
+		currentUser, err := user.Current()
+		if err != nil {
+			logger.Fatalf("Error setting cache-dir: %s\n", err)
+		}
+		cfg.cacheDir = filepath.Join(currentUser.HomeDir, ".k8s-token-cache")
 	}
-	defer resp.Body.Close()
 
-	respBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return tokenReviewResponse{}, err
+	if cfg.auditLog != "" {
+		auditLog = newAuditWriter(cfg.auditLog, cfg.auditLogMaxSize, cfg.auditLogMaxBackups, logger)
 	}
 
-	res := tokenReviewResponse{}
-	err = json.Unmarshal(respBody, &res)
-	return res, err
+	switch command {
+	case "":
+		credentialPlugin(logger)
+	case "logout":
+		logout(logger)
+	case "whoami":
+		whoami(logger)
+	case "doctor":
+		doctor(logger)
+	case "cache":
+		cacheCommand(logger, args)
+	case "exec":
+		execCommand(logger, args)
+	case "proxy":
+		apiProxy(logger)
+	case "serve-dev":
+		serveDev(logger)
+	case "docker-credential":
+		dockerCredentialHelper(logger, args)
+	default:
+		logger.Fatalf("Unknown command: %s\n", command)
+	}
+	return 0
 }
 
-// Request a token from token service.
-func requestToken(client *http.Client, username, password string) ([]byte, error) {
-	req, err := http.NewRequest("GET", cfg.tokenRequestEndpoint, nil)
-	if err != nil {
-		return nil, err
+// Parse flags, which may be interleaved with the command and its arguments. Arguments
+// after -- are returned untouched, even if they look like flags.
+func parseArgs(fs *flag.FlagSet, arguments []string) ([]string, error) {
+	var rest []string
+	for i, a := range arguments {
+		if a == "--" {
+			arguments, rest = arguments[:i], arguments[i+1:]
+			break
+		}
 	}
-	req.SetBasicAuth(username, password)
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	var positional []string
+	for {
+		if err := fs.Parse(arguments); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		arguments = fs.Args()[1:]
 	}
-	defer resp.Body.Close()
-	return ioutil.ReadAll(resp.Body)
+	return append(positional, rest...), nil
 }
 
-// Return token to kubectl on stdout.
-// https://kubernetes.io/docs/admin/authentication/#input-and-output-formats
-func outputToken(token []byte) error {
-	output, err := json.Marshal(newExecCredential(token))
+// Acquire a token, from the cache if still valid, and output an ExecCredential for kubectl.
+func credentialPlugin(logger *leveledLogger) {
+	source, err := newTokenSource(logger)
 	if err != nil {
-		return err
+		logger.Fatalf("Error %s\n", err)
 	}
-
-	_, err = fmt.Printf("%s", output)
-	return err
-}
-
-func readCredentials(username, password *string) error {
-	fmt.Fprintf(os.Stderr, "username: ")
-	fmt.Fscanf(os.Stdin, "%s", username)
-
-	fmt.Fprintf(os.Stderr, "password: ")
-	p, err := terminal.ReadPassword(int(syscall.Stdin))
+	token, user, err := source.token()
 	if err != nil {
-		return err
+		logger.Fatalf("Error %s\n", err)
 	}
-	*password = string(p)
 
-	return nil
+	// Write token to stdout to be used by kubectl.
+	if err = writeToken(stdout, token, user, cfg.output); err != nil {
+		logger.Fatalf("Unable to output token: %s\n", err)
+	}
 }
 
-func getHTTPClient() (*http.Client, error) {
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: cfg.skipTLSVerification,
+// Create clients for the token request and review endpoints, each with their own TLS settings.
+func getHTTPClients(logger *leveledLogger) (requestClient, reviewClient *http.Client, err error) {
+	if requestClient, err = getHTTPClient(cfg.requestTLS.merge(cfg.tls), logger); err != nil {
+		return nil, nil, fmt.Errorf("token request endpoint: %s", err)
 	}
-
-	if cfg.caCert != "" {
-		caCert, err := ioutil.ReadFile(cfg.caCert)
-		if err != nil {
-			return nil, err
-		}
-
-		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(caCert)
-		tlsConfig.RootCAs = caCertPool
+	if reviewClient, err = getHTTPClient(cfg.reviewTLS.merge(cfg.tls), logger); err != nil {
+		return nil, nil, fmt.Errorf("token review endpoint: %s", err)
 	}
+	return requestClient, reviewClient, nil
+}
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: tlsConfig,
+// Client for the token service that fails over between endpoints, retries, sends a one
+// time password, answers challenges and audits requests as configured.
+func tokenServiceClient(client *http.Client, otp string) *tokencache.Client {
+	c := &tokencache.Client{
+		HTTPClient: client,
+		Send: func(kind string, newRequest func(url string) (*http.Request, error), idempotent bool) (*http.Response, error) {
+			urls := cfg.tokenRequestEndpoints
+			if kind == reviewEndpoint {
+				urls = cfg.tokenReviewEndpoints
+			}
+			return doWithFailover(client, kind, urls, newRequest, idempotent)
 		},
+		SetCredentials: func(req *http.Request, username, password string) {
+			setCredentials(req, username, password, otp)
+		},
+		Audit: auditTokenService,
+	}
+	if cfg.challengeResponse {
+		c.Challenge = func(ctx context.Context, challenge string) (string, error) {
+			return answerChallenge(challenge)
+		}
 	}
+	return c
+}
+
+// Review token using the same endpoint that K8s will also use.
+// https://kubernetes.io/docs/admin/authentication/#webhook-token-authentication
+func reviewToken(client *http.Client, token []byte) (tokenReviewResponse, error) {
+	return tokenServiceClient(client, "").Review(context.Background(), token)
+}
 
-	return client, nil
+// Request a token from token service. If challenge-response is enabled and the service
+// returns a 401 with a challenge the user is prompted to answer it and the request retried.
+func requestToken(client *http.Client, username, password, otp string) ([]byte, error) {
+	return tokenServiceClient(client, otp).Request(context.Background(), username, password)
 }
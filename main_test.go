@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mweigel/token-cache-plugin/devserver"
+)
+
+func TestMain(m *testing.M) {
+	sleep = func(time.Duration) {}
+	os.Exit(m.Run())
+}
+
+// Terminal reading typed input from a buffer and recording what's written to it.
+type fakeTerminal struct {
+	in  *strings.Reader
+	out *bytes.Buffer
+}
+
+func (t *fakeTerminal) Read(p []byte) (int, error) {
+	return t.in.Read(p)
+}
+
+func (t *fakeTerminal) Write(p []byte) (int, error) {
+	return t.out.Write(p)
+}
+
+func (t *fakeTerminal) ReadPassword() ([]byte, error) {
+	line, err := readLine(t.in)
+	return []byte(line), err
+}
+
+func (t *fakeTerminal) Close() error {
+	return nil
+}
+
+// Token service and cache directory used by a test.
+type testEnv struct {
+	t       *testing.T
+	dir     string
+	server  *httptest.Server
+	tlsArgs []string
+}
+
+func newTestEnv(t *testing.T, config devserver.Config) *testEnv {
+	config.Users = append(config.Users, devserver.User{Name: "jdoe", Password: "secret", Groups: []string{"developers"}})
+	server := httptest.NewTLSServer(devserver.New(config))
+	t.Cleanup(server.Close)
+
+	dir, err := ioutil.TempDir("", "token-cache-plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	ca := filepath.Join(dir, "ca.pem")
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err = ioutil.WriteFile(ca, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &testEnv{t: t, dir: dir, server: server, tlsArgs: []string{"-ca-cert=" + ca}}
+}
+
+// Result of running the plugin.
+type result struct {
+	code     int
+	stdout   string
+	stderr   string
+	terminal string
+}
+
+// Run the plugin against the test's token service. Input is typed at the terminal, if
+// it's empty there's no terminal and any prompt fails.
+func (e *testEnv) run(input string, args ...string) result {
+	return e.runStdin("", input, args...)
+}
+
+// Run the plugin with stdin, as when it's run by Docker rather than kubectl.
+func (e *testEnv) runStdin(stdin, input string, args ...string) result {
+	term := &fakeTerminal{in: strings.NewReader(input), out: &bytes.Buffer{}}
+	openTerminal = func() (terminalIO, error) {
+		if input == "" {
+			return nil, errors.New("no terminal in test")
+		}
+		return term, nil
+	}
+	defer func() { openTerminal = openControllingTerminal }()
+
+	arguments := append([]string{
+		"-token-request-endpoint=" + e.server.URL + devserver.RequestPath,
+		"-token-review-endpoint=" + e.server.URL + devserver.ReviewPath,
+		"-token-path=" + filepath.Join(e.dir, "token"),
+		"-cache-dir=" + filepath.Join(e.dir, "cache"),
+	}, e.tlsArgs...)
+	arguments = append(arguments, args...)
+
+	var stdout, stderr bytes.Buffer
+	code := run(arguments, strings.NewReader(stdin), &stdout, &stderr)
+	return result{code: code, stdout: stdout.String(), stderr: stderr.String(), terminal: term.out.String()}
+}
+
+// Issue a token directly from the token service.
+func (e *testEnv) issue() string {
+	req, err := http.NewRequest("GET", e.server.URL+devserver.RequestPath, nil)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	req.SetBasicAuth("jdoe", "secret")
+	resp, err := e.server.Client().Do(req)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return string(b)
+}
+
+func (e *testEnv) cache(token string) {
+	if err := ioutil.WriteFile(filepath.Join(e.dir, "token"), []byte(token), 0600); err != nil {
+		e.t.Fatal(err)
+	}
+}
+
+func (e *testEnv) cached() string {
+	b, err := ioutil.ReadFile(filepath.Join(e.dir, "token"))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return string(b)
+}
+
+// Token from the ExecCredential written to stdout.
+func (r result) token(t *testing.T) string {
+	if r.code != 0 {
+		t.Fatalf("exit status %d, stderr:\n%s", r.code, r.stderr)
+	}
+	var cred execCredential
+	if err := json.Unmarshal([]byte(r.stdout), &cred); err != nil {
+		t.Fatalf("decoding ExecCredential %q: %s", r.stdout, err)
+	}
+	if cred.Kind != "ExecCredential" || cred.Status["token"] == "" {
+		t.Fatalf("unexpected ExecCredential %q", r.stdout)
+	}
+	return cred.Status["token"]
+}
+
+func TestMissingCache(t *testing.T) {
+	e := newTestEnv(t, devserver.Config{})
+
+	r := e.run("jdoe\nsecret\n")
+	token := r.token(t)
+	if r.terminal != "username: password: \n" {
+		t.Errorf("terminal = %q, want username and password prompts", r.terminal)
+	}
+	if cached := e.cached(); cached != token {
+		t.Errorf("cached token = %q, want %q", cached, token)
+	}
+
+	// The cached token is used next time without prompting.
+	if again := e.run("").token(t); again != token {
+		t.Errorf("second run token = %q, want cached %q", again, token)
+	}
+}
+
+func TestValidCachedToken(t *testing.T) {
+	e := newTestEnv(t, devserver.Config{})
+	token := e.issue()
+	e.cache(token)
+
+	r := e.run("")
+	if got := r.token(t); got != token {
+		t.Errorf("token = %q, want cached %q", got, token)
+	}
+}
+
+func TestExpiredToken(t *testing.T) {
+	e := newTestEnv(t, devserver.Config{TokenTTL: time.Second})
+	expired := e.issue()
+	e.cache(expired)
+	time.Sleep(1100 * time.Millisecond)
+
+	r := e.run("jdoe\nsecret\n")
+	token := r.token(t)
+	if token == expired {
+		t.Error("expired token was reused")
+	}
+	if !strings.Contains(r.terminal, "password: ") {
+		t.Errorf("terminal = %q, want password prompt", r.terminal)
+	}
+	if cached := e.cached(); cached != token {
+		t.Errorf("cached token = %q, want %q", cached, token)
+	}
+}
+
+func TestBadCredentials(t *testing.T) {
+	e := newTestEnv(t, devserver.Config{})
+
+	r := e.run("jdoe\nwrong\n")
+	if r.code != 1 {
+		t.Errorf("exit status = %d, want 1", r.code)
+	}
+	if r.stdout != "" {
+		t.Errorf("stdout = %q, want nothing", r.stdout)
+	}
+	if !strings.Contains(r.stderr, "401") {
+		t.Errorf("stderr = %q, want 401 from the token request endpoint", r.stderr)
+	}
+	if _, err := os.Stat(filepath.Join(e.dir, "token")); !os.IsNotExist(err) {
+		t.Errorf("token cached after failed login: %v", err)
+	}
+}
+
+func TestMalformedReview(t *testing.T) {
+	e := newTestEnv(t, devserver.Config{MalformedRate: 1})
+	cachedToken := e.issue()
+	e.cache(cachedToken)
+
+	// A review that can't be decoded doesn't authenticate the cached token, so a new one is requested.
+	r := e.run("jdoe\nsecret\n")
+	if token := r.token(t); token == cachedToken {
+		t.Error("token with malformed review was reused")
+	}
+	if !strings.Contains(r.stderr, "Error reviewing cached token") {
+		t.Errorf("stderr = %q, want review error", r.stderr)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    func(e *testEnv) []string
+		wantErr string
+	}{
+		{"unknown CA", func(e *testEnv) []string { return nil }, "certificate"},
+		{"ca-cert", func(e *testEnv) []string { return e.tlsArgs }, ""},
+		{"wrong ca-cert", func(e *testEnv) []string { return []string{"-ca-cert=" + writeCA(t, e.dir)} }, "certificate"},
+		{"skip-tls-verification", func(e *testEnv) []string { return []string{"-skip-tls-verification"} }, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnv(t, devserver.Config{})
+			e.tlsArgs = test.args(e)
+
+			r := e.run("jdoe\nsecret\n", "-max-retries=0")
+			if test.wantErr == "" {
+				r.token(t)
+				return
+			}
+			if r.code == 0 {
+				t.Fatalf("succeeded, want error containing %q", test.wantErr)
+			}
+			if !strings.Contains(r.stderr, test.wantErr) {
+				t.Errorf("stderr = %q, want error containing %q", r.stderr, test.wantErr)
+			}
+		})
+	}
+}
+
+// Write a self-signed CA that didn't issue the test server's certificate.
+func writeCA(t *testing.T, dir string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "other CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "other-ca.pem")
+	if err = ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPinentryLogin(t *testing.T) {
+	e := newTestEnv(t, devserver.Config{})
+	os.Setenv(fakePinentryEnv, "secret")
+	defer os.Unsetenv(fakePinentryEnv)
+
+	// No terminal is needed with the username given and the password from pinentry.
+	r := e.run("", "-username=jdoe", "-pinentry="+os.Args[0])
+	r.token(t)
+}
+
+func TestMissingCacheNotReviewed(t *testing.T) {
+	e := newTestEnv(t, devserver.Config{})
+	reviews := 0
+	handler := e.server.Config.Handler
+	e.server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == devserver.ReviewPath {
+			reviews++
+		}
+		handler.ServeHTTP(w, r)
+	})
+
+	e.run("jdoe\nsecret\n").token(t)
+	if reviews != 0 {
+		t.Errorf("%d token reviews without a cached token, want none", reviews)
+	}
+}
+
+// Drop connections to the token review endpoint, as if it were down.
+func (e *testEnv) reviewUnreachable() {
+	handler := e.server.Config.Handler
+	e.server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != devserver.ReviewPath {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			e.t.Fatal(err)
+		}
+		conn.Close()
+	})
+}
+
+// Cache a token and have it reviewed, so that it may be used offline.
+func (e *testEnv) cacheReviewed() string {
+	token := e.issue()
+	e.cache(token)
+	if r := e.run(""); r.token(e.t) != token {
+		e.t.Fatalf("cached token wasn't used, stderr:\n%s", r.stderr)
+	}
+	return token
+}
+
+func TestOfflineGrace(t *testing.T) {
+	e := newTestEnv(t, devserver.Config{})
+	token := e.cacheReviewed()
+	e.reviewUnreachable()
+
+	r := e.run("")
+	if got := r.token(t); got != token {
+		t.Errorf("token = %q, want cached %q", got, token)
+	}
+	if !strings.Contains(r.stderr, "Token review endpoint unreachable, using cached token last reviewed") {
+		t.Errorf("stderr = %q, want a warning the token is used offline", r.stderr)
+	}
+}
+
+func TestOfflineGraceElapsed(t *testing.T) {
+	e := newTestEnv(t, devserver.Config{})
+	e.cacheReviewed()
+	e.reviewUnreachable()
+
+	r := e.run("", "-offline-grace=1ns")
+	if r.code == 0 || r.stdout != "" {
+		t.Errorf("exit status %d, stdout %q, want the cached token refused outside the grace period", r.code, r.stdout)
+	}
+	if strings.Contains(r.stderr, "using cached token") {
+		t.Errorf("stderr = %q, want the cached token not used", r.stderr)
+	}
+}
+
+func TestOfflineGraceExpiredToken(t *testing.T) {
+	e := newTestEnv(t, devserver.Config{TokenTTL: time.Second})
+	e.cacheReviewed()
+	e.reviewUnreachable()
+	time.Sleep(1100 * time.Millisecond)
+
+	r := e.run("")
+	if r.code == 0 || r.stdout != "" {
+		t.Errorf("exit status %d, stdout %q, want the expired token refused", r.code, r.stdout)
+	}
+	if strings.Contains(r.stderr, "using cached token") {
+		t.Errorf("stderr = %q, want the expired token not used", r.stderr)
+	}
+}
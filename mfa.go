@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mweigel/token-cache-plugin/tokencache"
+)
+
+// Ways a one time password can be sent to the token request endpoint.
+const (
+	otpModeNone   = ""
+	otpModeAppend = "append"
+	otpModeHeader = "header"
+)
+
+// Obtain a one time password if a second factor is configured, either generated locally
+// from a TOTP seed or prompted for.
+func readOTP() (string, error) {
+	switch cfg.otpMode {
+	case otpModeNone:
+		return "", nil
+	case otpModeAppend, otpModeHeader:
+	default:
+		return "", fmt.Errorf("unknown otp-mode %q", cfg.otpMode)
+	}
+
+	if cfg.totpSecretFile != "" {
+		secret, err := readTOTPSecret(cfg.totpSecretFile)
+		if err != nil {
+			return "", err
+		}
+		return totp(secret, time.Now()), nil
+	}
+	return promptLine("one time password: ")
+}
+
+// Attach credentials and one time password to a token request according to otp-mode.
+// Basic auth is omitted when authenticating with a client certificate alone.
+func setCredentials(req *http.Request, username, password, otp string) {
+	switch cfg.otpMode {
+	case otpModeAppend:
+		password += otp
+	case otpModeHeader:
+		req.Header.Set(cfg.otpHeader, otp)
+	}
+	if username != "" || password != "" {
+		req.SetBasicAuth(username, password)
+	}
+}
+
+// Display a challenge issued by the token request endpoint and read the user's answer.
+func answerChallenge(challenge string) (string, error) {
+	return promptLine(challenge + ": ")
+}
+
+// Read a base32 encoded TOTP seed as displayed by most authenticator enrolment pages. Like
+// cached tokens, the seed isn't used if others could read or replace it, unless strict modes
+// are off.
+func readTOTPSecret(path string) ([]byte, error) {
+	read := tokencache.ReadPrivateFile
+	if cfg.strictModes == strictModesOff {
+		read = ioutil.ReadFile
+	}
+	b, err := read(path)
+	if err != nil {
+		return nil, err
+	}
+	s := strings.ToUpper(strings.Replace(strings.TrimSpace(string(b)), " ", "", -1))
+	s = strings.TrimRight(s, "=")
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TOTP secret in %s: %s", path, err)
+	}
+	return secret, nil
+}
+
+// Generate a six digit TOTP using HMAC-SHA1 and a 30 second step.
+// https://tools.ietf.org/html/rfc6238
+func totp(secret []byte, t time.Time) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(t.Unix()/30))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000)
+}
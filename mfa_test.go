@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mweigel/token-cache-plugin/tokencache"
+)
+
+// RFC 6238 appendix B test vectors for HMAC-SHA1, truncated to six digits.
+func TestTOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		if got := totp(secret, time.Unix(test.unix, 0)); got != test.want {
+			t.Errorf("totp at %d = %s, want %s", test.unix, got, test.want)
+		}
+	}
+}
+
+func TestReadTOTPSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "totp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		contents string
+		wantErr  bool
+	}{
+		// base32 of 12345678901234567890, as shown by enrolment pages.
+		{"GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ\n", false},
+		{"gezd gnbv gy3t qojq gezd gnbv gy3t qojq", false},
+		{"GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ====", false},
+		{"not base32!", true},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, "secret")
+		if err = ioutil.WriteFile(path, []byte(test.contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		secret, err := readTOTPSecret(path)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("readTOTPSecret(%q) succeeded, want error", test.contents)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("readTOTPSecret(%q): %s", test.contents, err)
+		} else if string(secret) != "12345678901234567890" {
+			t.Errorf("readTOTPSecret(%q) = %q", test.contents, secret)
+		}
+	}
+}
+
+func TestReadTOTPSecretPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file permissions aren't checked on Windows")
+	}
+	dir, err := ioutil.TempDir("", "totp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { cfg = config{} }()
+
+	path := filepath.Join(dir, "secret")
+	if err = ioutil.WriteFile(path, []byte("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readTOTPSecret(path); err == nil || !strings.Contains(err.Error(), "accessible to other users") {
+		t.Errorf("readTOTPSecret of a 0644 seed = %v, want it refused", err)
+	}
+	cfg = config{strictModes: strictModesOff}
+	if _, err = readTOTPSecret(path); err != nil {
+		t.Errorf("readTOTPSecret with strict modes off: %s", err)
+	}
+}
+
+func TestSetCredentials(t *testing.T) {
+	defer func() { cfg = config{} }()
+	tests := []struct {
+		mode         string
+		username     string
+		wantPassword string
+		wantHeader   string
+		wantBasic    bool
+	}{
+		{otpModeNone, "jdoe", "secret", "", true},
+		{otpModeAppend, "jdoe", "secret123456", "", true},
+		{otpModeHeader, "jdoe", "secret", "123456", true},
+		{otpModeNone, "", "", "", false},
+	}
+	for _, test := range tests {
+		cfg = config{otpMode: test.mode, otpHeader: "X-OTP"}
+		req := httptest.NewRequest("GET", "https://token.example.com/ldapAuth", nil)
+		password := "secret"
+		if test.username == "" {
+			password = ""
+		}
+		otp := "123456"
+		if test.mode == otpModeNone {
+			otp = ""
+		}
+		setCredentials(req, test.username, password, otp)
+
+		_, gotPassword, ok := req.BasicAuth()
+		if ok != test.wantBasic || gotPassword != test.wantPassword {
+			t.Errorf("%s: basic auth = %t %q, want %t %q", test.mode, ok, gotPassword, test.wantBasic, test.wantPassword)
+		}
+		if got := req.Header.Get("X-OTP"); got != test.wantHeader {
+			t.Errorf("%s: header = %q, want %q", test.mode, got, test.wantHeader)
+		}
+	}
+}
+
+func TestChallengeResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(tokencache.ChallengeResponseHeader) == "" {
+			w.Header().Set(tokencache.ChallengeHeader, "Enter the code sent to your phone")
+			w.Header().Set(tokencache.ChallengeStateHeader, "state-1")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get(tokencache.ChallengeResponseHeader) != "424242" || r.Header.Get(tokencache.ChallengeStateHeader) != "state-1" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("token"))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "challenge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg = config{tokenRequestEndpoints: stringSlice{server.URL}, challengeResponse: true, cacheDir: dir, otpMode: otpModeNone}
+	defer func() { cfg = config{} }()
+
+	term := &fakeTerminal{in: strings.NewReader("424242\n"), out: &bytes.Buffer{}}
+	openTerminal = func() (terminalIO, error) { return term, nil }
+	defer func() { openTerminal = openControllingTerminal }()
+
+	token, err := requestToken(server.Client(), "jdoe", "secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(token) != "token" {
+		t.Errorf("token = %q, want %q", token, "token")
+	}
+	if !strings.Contains(term.out.String(), "Enter the code sent to your phone: ") {
+		t.Errorf("terminal = %q, want the challenge", term.out.String())
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mweigel/token-cache-plugin/tokencache"
+)
+
+// Whether reviewing a token failed because no token review endpoint could be reached or
+// gave an answer, as opposed to the token being rejected.
+func isUnreachable(err error) bool {
+	return errors.Is(err, tokencache.ErrUnreachable)
+}
+
+// Report whether a cached token may still be used while the token review endpoint is
+// unreachable. The token must not be known to have expired and must have been reviewed,
+// or issued, within the offline grace period.
+func withinOfflineGrace(token []byte, now time.Time, logger *leveledLogger) bool {
+	if cfg.offlineGrace <= 0 || len(token) == 0 {
+		return false
+	}
+	if expiry, ok := tokencache.Expiry(token); ok && !expiry.After(now) {
+		logger.Debugf("Cached token expired at %s, not using it offline\n", expiry.Format(time.RFC3339))
+		return false
+	}
+
+	index, err := localCache().ReadIndex()
+	if err != nil {
+		return false
+	}
+	lastReviewed := index[tokencache.Key(cfg.tokenPath)].LastReviewed
+	if lastReviewed.IsZero() {
+		logger.Debugf("Cached token has never been reviewed, not using it offline\n")
+		return false
+	}
+	if now.Sub(lastReviewed) > cfg.offlineGrace {
+		logger.Debugf("Cached token last reviewed %s, outside the offline grace period\n", lastReviewed.Format(time.RFC3339))
+		return false
+	}
+
+	logger.Warnf("Token review endpoint unreachable, using cached token last reviewed %s ago\n", now.Sub(lastReviewed).Truncate(time.Second))
+	return true
+}
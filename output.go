@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/mweigel/token-cache-plugin/tokencache"
+)
+
+// Formats a token can be output in. ExecCredential is what kubectl expects, the others are
+// for scripts and tools that just need the token.
+const (
+	outputExecCredential = "execcredential"
+	outputToken          = "token"
+	outputHeader         = "header"
+	outputBash           = "bash"
+	outputFish           = "fish"
+	outputJSON           = "json"
+	outputCurl           = "curl"
+)
+
+// Token output with -output=json.
+type tokenOutput struct {
+	Token     string     `json:"token"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Username  string     `json:"username,omitempty"`
+	UID       string     `json:"uid,omitempty"`
+	Groups    []string   `json:"groups,omitempty"`
+}
+
+func writeToken(w io.Writer, token []byte, user k8suser, format string) error {
+	t := strings.TrimSpace(string(token))
+
+	switch format {
+	case outputExecCredential:
+		// https://kubernetes.io/docs/admin/authentication/#input-and-output-formats
+		output, err := json.Marshal(newExecCredential(token))
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s", output)
+		return err
+	case outputToken:
+		_, err := fmt.Fprintln(w, t)
+		return err
+	case outputHeader:
+		_, err := fmt.Fprintf(w, "Authorization: Bearer %s\n", t)
+		return err
+	case outputBash:
+		_, err := fmt.Fprintf(w, "export %s=%s\n", cfg.outputEnvVar, bashQuote(t))
+		return err
+	case outputFish:
+		_, err := fmt.Fprintf(w, "set -gx %s %s\n", cfg.outputEnvVar, fishQuote(t))
+		return err
+	case outputJSON:
+		out := tokenOutput{Token: t, Username: user.Username, UID: user.UID, Groups: user.Groups}
+		if expiry, ok := tokencache.Expiry(token); ok {
+			out.ExpiresAt = &expiry
+		}
+		return json.NewEncoder(w).Encode(out)
+	case outputCurl:
+		// Suitable for curl -K, or --config.
+		_, err := fmt.Fprintf(w, "header = %s\n", curlQuote("Authorization: Bearer "+t))
+		return err
+	}
+	return fmt.Errorf("unknown output %q", format)
+}
+
+// Quote a value for bash, within single quotes nothing is special except the single quote.
+func bashQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Quote a value for a curl config file, which allows double quotes and backslashes to be
+// escaped within double quotes.
+func curlQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+// Quote a value for fish, which allows single quotes and backslashes to be escaped within
+// single quotes.
+func fishQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return "'" + strings.Replace(s, "'", `\'`, -1) + "'"
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteToken(t *testing.T) {
+	cfg = config{outputEnvVar: "TOKEN"}
+	defer func() { cfg = config{} }()
+
+	tests := []struct {
+		format string
+		token  string
+		want   string
+	}{
+		{outputToken, "abc\n", "abc\n"},
+		{outputHeader, "abc", "Authorization: Bearer abc\n"},
+		{outputBash, `it's`, `export TOKEN='it'\''s'` + "\n"},
+		{outputFish, `it's \`, `set -gx TOKEN 'it\'s \\'` + "\n"},
+		{outputCurl, "abc", `header = "Authorization: Bearer abc"` + "\n"},
+		{outputCurl, `a"b`, `header = "Authorization: Bearer a\"b"` + "\n"},
+		{outputCurl, `a\"b\`, `header = "Authorization: Bearer a\\\"b\\"` + "\n"},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		if err := writeToken(&b, []byte(test.token), k8suser{}, test.format); err != nil {
+			t.Fatalf("%s: %s", test.format, err)
+		}
+		if b.String() != test.want {
+			t.Errorf("%s of %q = %q, want %q", test.format, test.token, b.String(), test.want)
+		}
+	}
+	if err := writeToken(&bytes.Buffer{}, []byte("abc"), k8suser{}, "xml"); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
@@ -0,0 +1,37 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Flag opening a file that fails if it's a symlink.
+const openNoFollow = syscall.O_NOFOLLOW
+
+// Owner of a file, if the platform records one.
+func fileOwner(info os.FileInfo) (int, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1, false
+	}
+	return int(st.Uid), true
+}
+
+// Whether opening a file with openNoFollow failed because it's a symlink. FreeBSD reports
+// EMLINK rather than ELOOP.
+func isSymlinkError(err error) bool {
+	return errors.Is(err, syscall.ELOOP) || errors.Is(err, syscall.EMLINK)
+}
+
+// Listen on a Unix socket created with no access for others, so that there's no window
+// between creating it and restricting its mode in which others could connect.
+func listenUnix(path string) (net.Listener, error) {
+	umask := syscall.Umask(0077)
+	defer syscall.Umask(umask)
+	return net.Listen("unix", path)
+}
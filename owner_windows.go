@@ -0,0 +1,26 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// File ownership isn't checked on Windows, where access is controlled by ACLs.
+func fileOwner(info os.FileInfo) (int, bool) {
+	return -1, false
+}
+
+// Symlinks aren't checked on Windows.
+const openNoFollow = 0
+
+func isSymlinkError(err error) bool {
+	return false
+}
+
+// Access to Unix sockets on Windows is controlled by ACLs rather than a umask.
+func listenUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
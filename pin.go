@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Prefix accepted on pins, matching the format used by curl's --pinnedpubkey.
+const pinPrefix = "sha256//"
+
+// Hash of a certificate's DER encoded SubjectPublicKeyInfo, base64 encoded.
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Parse pins, validating each is a base64 encoded SHA-256 hash.
+func parsePins(pins []string) (map[string]bool, error) {
+	parsed := make(map[string]bool, len(pins))
+	for _, pin := range pins {
+		pin = strings.TrimPrefix(strings.TrimSpace(pin), pinPrefix)
+		b, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin %q, expected a base64 encoded SHA-256 hash", pin)
+		}
+		parsed[pin] = true
+	}
+	return parsed, nil
+}
+
+// Require a certificate in the server's verified chain to match a pinned public key. Any
+// certificate in the chain may be pinned, allowing an intermediate to be pinned rather than
+// the leaf. Multiple pins allow keys to be rotated. Only verified chains are considered, as
+// a server can present any certificate alongside its own. With skip-tls-verification there
+// are no verified chains and only the leaf can be pinned.
+func pinPublicKeys(tlsConfig *tls.Config, pins []string) error {
+	if len(pins) == 0 {
+		return nil
+	}
+	pinned, err := parsePins(pins)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		chains := verifiedChains
+		if tlsConfig.InsecureSkipVerify {
+			if len(rawCerts) == 0 {
+				return errors.New("no certificate presented")
+			}
+			leaf, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			chains = [][]*x509.Certificate{{leaf}}
+		}
+
+		var presented []string
+		for _, chain := range chains {
+			for _, cert := range chain {
+				hash := spkiHash(cert)
+				if pinned[hash] {
+					return nil
+				}
+				presented = append(presented, fmt.Sprintf("%s%s (%s)", pinPrefix, hash, cert.Subject.CommonName))
+			}
+		}
+		return fmt.Errorf("no verified certificate matches a pinned public key, verified: %s", strings.Join(presented, ", "))
+	}
+	return nil
+}
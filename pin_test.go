@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Certificate and key generated for a test.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// Generate a certificate signed by parent, or self-signed if parent is nil.
+func newTestCert(t *testing.T, name string, isCA bool, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+// Serve TLS presenting chain, the first certificate of which belongs to key.
+func newPinTestServer(t *testing.T, key *ecdsa.PrivateKey, chain ...*x509.Certificate) *httptest.Server {
+	var certs [][]byte
+	for _, c := range chain {
+		certs = append(certs, c.Raw)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: certs, PrivateKey: key}}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPinPublicKeys(t *testing.T) {
+	ca := newTestCert(t, "trusted CA", true, nil)
+	leaf := newTestCert(t, "server", false, ca)
+	// A certificate a man-in-the-middle doesn't hold the key for, such as the real server's.
+	pinnedElsewhere := newTestCert(t, "pinned server", false, nil)
+
+	tests := []struct {
+		name     string
+		chain    []*x509.Certificate
+		pin      *x509.Certificate
+		insecure bool
+		wantErr  bool
+	}{
+		{"pinned leaf", []*x509.Certificate{leaf.cert}, leaf.cert, false, false},
+		{"pinned CA", []*x509.Certificate{leaf.cert}, ca.cert, false, false},
+		{"unpinned server", []*x509.Certificate{leaf.cert}, pinnedElsewhere.cert, false, true},
+		{"appended pinned certificate", []*x509.Certificate{leaf.cert, pinnedElsewhere.cert}, pinnedElsewhere.cert, false, true},
+		{"insecure pinned leaf", []*x509.Certificate{leaf.cert}, leaf.cert, true, false},
+		{"insecure pinned CA", []*x509.Certificate{leaf.cert, ca.cert}, ca.cert, true, true},
+		{"insecure appended pinned certificate", []*x509.Certificate{leaf.cert, pinnedElsewhere.cert}, pinnedElsewhere.cert, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newPinTestServer(t, leaf.key, test.chain...)
+
+			roots := x509.NewCertPool()
+			roots.AddCert(ca.cert)
+			tlsConfig := &tls.Config{RootCAs: roots, InsecureSkipVerify: test.insecure}
+			if err := pinPublicKeys(tlsConfig, []string{pinPrefix + spkiHash(test.pin)}); err != nil {
+				t.Fatal(err)
+			}
+
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+			resp, err := client.Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if test.wantErr && err == nil {
+				t.Error("connection succeeded, want pin failure")
+			}
+			if !test.wantErr && err != nil {
+				t.Errorf("connection failed: %s", err)
+			}
+		})
+	}
+}
+
+func TestParsePins(t *testing.T) {
+	valid := "YLh1dUR9y6Kja30RrAn7JKnbQG/uEtLMkBgFF2Fuihg="
+	for _, pin := range []string{valid, pinPrefix + valid, " " + valid + " "} {
+		if pins, err := parsePins([]string{pin}); err != nil || !pins[valid] {
+			t.Errorf("parsePins(%q) = %v, %v", pin, pins, err)
+		}
+	}
+	for _, pin := range []string{"", "not base64!", "c2hvcnQ="} {
+		if _, err := parsePins([]string{pin}); err == nil {
+			t.Errorf("parsePins(%q) succeeded, want error", pin)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Client for the Assuan protocol spoken by pinentry programs, as used by GnuPG to prompt
+// for passphrases. The reader and writer are the program's stdout and stdin respectively,
+// allowing a fake pinentry to be substituted.
+// https://www.gnupg.org/documentation/manuals/assuan/
+type pinentry struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+// Create a pinentry client, consuming the greeting sent once the program has started.
+func newPinentry(r io.Reader, w io.Writer) (*pinentry, error) {
+	p := &pinentry{r: bufio.NewReader(r), w: w}
+	if _, err := p.response(); err != nil {
+		return nil, fmt.Errorf("pinentry greeting: %s", err)
+	}
+	return p, nil
+}
+
+// Prompt for a PIN, or in our case a password, showing the supplied description and prompt.
+func (p *pinentry) getPin(desc, prompt string) (string, error) {
+	if _, err := p.command("SETDESC " + assuanEscape(desc)); err != nil {
+		return "", err
+	}
+	if _, err := p.command("SETPROMPT " + assuanEscape(prompt)); err != nil {
+		return "", err
+	}
+	return p.command("GETPIN")
+}
+
+// Tell pinentry which terminal to prompt on. Terminal based pinentry programs such as
+// pinentry-curses otherwise use their stdin and stdout, which are pipes to the plugin.
+// Empty values aren't sent.
+func (p *pinentry) setTTY(ttyname, ttytype string) error {
+	if ttyname != "" {
+		if _, err := p.command("OPTION ttyname=" + assuanEscape(ttyname)); err != nil {
+			return err
+		}
+	}
+	if ttytype != "" {
+		if _, err := p.command("OPTION ttytype=" + assuanEscape(ttytype)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send a command and wait for it to complete, returning any data lines sent in response.
+func (p *pinentry) command(cmd string) (string, error) {
+	if _, err := fmt.Fprintf(p.w, "%s\n", cmd); err != nil {
+		return "", err
+	}
+	return p.response()
+}
+
+func (p *pinentry) response() (string, error) {
+	var data []string
+	for {
+		line, err := p.r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return assuanUnescape(strings.Join(data, "")), nil
+		case strings.HasPrefix(line, "ERR "):
+			return "", fmt.Errorf("pinentry: %s", line[len("ERR "):])
+		case strings.HasPrefix(line, "D "):
+			data = append(data, line[len("D "):])
+		case strings.HasPrefix(line, "INQUIRE "):
+			// Nothing is ever inquired by pinentry for the commands we send, cancel to avoid deadlock.
+			if _, err := fmt.Fprintf(p.w, "CAN\n"); err != nil {
+				return "", err
+			}
+		case strings.HasPrefix(line, "S ") || strings.HasPrefix(line, "#") || line == "":
+			// Status and comment lines are informational only.
+		default:
+			return "", fmt.Errorf("pinentry: unexpected response %q", line)
+		}
+	}
+}
+
+// Ask the user for a password using the given pinentry program.
+func pinentryPassword(program, desc, prompt string) (string, error) {
+	cmd := exec.Command(program)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err = cmd.Start(); err != nil {
+		return "", err
+	}
+	defer cmd.Wait()
+	defer stdin.Close()
+
+	p, err := newPinentry(stdout, stdin)
+	if err != nil {
+		return "", err
+	}
+	// Pinentry programs that don't use a terminal may reject the options, which is harmless.
+	p.setTTY(pinentryTTYName(), os.Getenv("TERM"))
+	password, err := p.getPin(desc, prompt)
+	p.command("BYE")
+	if err != nil {
+		return "", err
+	}
+	if password == "" {
+		return "", errors.New("pinentry: no password entered")
+	}
+	return password, nil
+}
+
+// Name of the terminal pinentry should prompt on, as GnuPG uses GPG_TTY. Otherwise the
+// controlling terminal, if there is one.
+func pinentryTTYName() string {
+	if name := os.Getenv("GPG_TTY"); name != "" {
+		return name
+	}
+	if runtime.GOOS == "windows" {
+		return ""
+	}
+	f, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return ""
+	}
+	f.Close()
+	return "/dev/tty"
+}
+
+// Percent-encode characters that can't appear in an Assuan line.
+func assuanEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '%' || c < 0x20 {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func assuanUnescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
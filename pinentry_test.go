@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Environment variable holding the password a fake pinentry, run as the test binary,
+// answers with. An empty password cancels.
+const fakePinentryEnv = "TOKEN_CACHE_PLUGIN_FAKE_PINENTRY"
+
+// The test binary doubles as a fake pinentry program, see TestPinentryPassword.
+func init() {
+	if password, ok := os.LookupEnv(fakePinentryEnv); ok {
+		fakePinentry(os.Stdin, os.Stdout, password)
+		os.Exit(0)
+	}
+}
+
+// Minimal pinentry, recording the commands it's sent.
+func fakePinentry(r io.Reader, w io.Writer, password string) []string {
+	var commands []string
+	fmt.Fprintln(w, "OK Pleased to meet you")
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		cmd := scanner.Text()
+		commands = append(commands, cmd)
+		switch cmd {
+		case "GETPIN":
+			if password == "" {
+				fmt.Fprintln(w, "ERR 83886179 Operation cancelled <Pinentry>")
+				continue
+			}
+			fmt.Fprintf(w, "S PASSWORD_FROM_CACHE\nD %s\nOK\n", assuanEscape(password))
+		case "BYE":
+			fmt.Fprintln(w, "OK closing connection")
+			return commands
+		default:
+			fmt.Fprintln(w, "OK")
+		}
+	}
+	return commands
+}
+
+func TestPinentryGetPin(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		want     string
+		wantErr  string
+	}{
+		{"password", "s3cret", "s3cret", ""},
+		{"escaped", "100%\nsure", "100%\nsure", ""},
+		{"cancelled", "", "", "Operation cancelled"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clientR, serverW := io.Pipe()
+			serverR, clientW := io.Pipe()
+			commands := make(chan []string)
+			go func() {
+				commands <- fakePinentry(serverR, serverW, test.password)
+				serverW.Close()
+			}()
+
+			p, err := newPinentry(clientR, clientW)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.getPin("Password for 50% of\nusers", "password:")
+			p.command("BYE")
+			clientW.Close()
+
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("error = %v, want %q", err, test.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("pin = %q, want %q", got, test.want)
+			}
+
+			sent := <-commands
+			if len(sent) == 0 || sent[0] != "SETDESC Password for 50%25 of%0Ausers" {
+				t.Errorf("commands = %q, want escaped SETDESC first", sent)
+			}
+		})
+	}
+}
+
+func TestPinentryPassword(t *testing.T) {
+	os.Setenv(fakePinentryEnv, "s3cret")
+	defer os.Unsetenv(fakePinentryEnv)
+
+	got, err := pinentryPassword(os.Args[0], "Password for jdoe", "password:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "s3cret" {
+		t.Errorf("password = %q, want %q", got, "s3cret")
+	}
+}
+
+func TestPinentryPasswordCancelled(t *testing.T) {
+	os.Setenv(fakePinentryEnv, "")
+	defer os.Unsetenv(fakePinentryEnv)
+
+	if _, err := pinentryPassword(os.Args[0], "Password for jdoe", "password:"); err == nil {
+		t.Error("cancelled pinentry returned a password")
+	}
+}
+
+func TestPinentrySetTTY(t *testing.T) {
+	clientR, serverW := io.Pipe()
+	serverR, clientW := io.Pipe()
+	commands := make(chan []string)
+	go func() {
+		commands <- fakePinentry(serverR, serverW, "")
+		serverW.Close()
+	}()
+
+	p, err := newPinentry(clientR, clientW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.setTTY("/dev/pts/3", "xterm-256color"); err != nil {
+		t.Fatal(err)
+	}
+	p.command("BYE")
+	clientW.Close()
+
+	want := []string{"OPTION ttyname=/dev/pts/3", "OPTION ttytype=xterm-256color", "BYE"}
+	if got := <-commands; strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
+
+func TestPinentryTTYName(t *testing.T) {
+	old, set := os.LookupEnv("GPG_TTY")
+	os.Setenv("GPG_TTY", "/dev/pts/7")
+	defer func() {
+		if set {
+			os.Setenv("GPG_TTY", old)
+		} else {
+			os.Unsetenv("GPG_TTY")
+		}
+	}()
+
+	if got := pinentryTTYName(); got != "/dev/pts/7" {
+		t.Errorf("ttyname = %q, want GPG_TTY", got)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Controlling terminal used to prompt for credentials. Input and output may be separate
+// handles depending on the platform.
+type tty struct {
+	in  *os.File
+	out *os.File
+}
+
+// Terminal credentials are prompted for on.
+type terminalIO interface {
+	io.ReadWriteCloser
+	// Read a line without echoing it.
+	ReadPassword() ([]byte, error)
+}
+
+// Open the terminal to prompt on, replaced by tests with a fake terminal.
+var openTerminal = openControllingTerminal
+
+func (t *tty) Read(p []byte) (int, error) {
+	return t.in.Read(p)
+}
+
+func (t *tty) Write(p []byte) (int, error) {
+	return t.out.Write(p)
+}
+
+func (t *tty) ReadPassword() ([]byte, error) {
+	return terminal.ReadPassword(int(t.in.Fd()))
+}
+
+func (t *tty) Close() error {
+	err := t.in.Close()
+	if t.out != t.in {
+		if outErr := t.out.Close(); err == nil {
+			err = outErr
+		}
+	}
+	return err
+}
+
+// Prompt for a username and password on the controlling terminal. Stdin is not used as
+// it may be a pipe when kubectl is run as part of a pipeline e.g. cat x.yaml | kubectl apply -f -
+// If username is already populated only the password is prompted for.
+func readCredentials(username, password *string) error {
+	if *username == "" {
+		u, err := promptLine("username: ")
+		if err != nil {
+			return err
+		}
+		*username = u
+	}
+
+	p, err := promptSecret(fmt.Sprintf("Enter the password for %s", *username), "password: ")
+	if err != nil {
+		return err
+	}
+	*password = p
+
+	return nil
+}
+
+// Prompt for input that shouldn't be echoed. A pinentry program is used if configured,
+// otherwise the controlling terminal. The description is only shown by pinentry.
+func promptSecret(desc, prompt string) (string, error) {
+	if cfg.pinentry != "" {
+		return pinentryPassword(cfg.pinentry, desc, strings.TrimSpace(prompt))
+	}
+
+	t, err := openTerminal()
+	if err != nil {
+		return "", err
+	}
+	defer t.Close()
+
+	fmt.Fprintf(t, "%s", prompt)
+	p, err := t.ReadPassword()
+	fmt.Fprintln(t)
+	if err != nil {
+		return "", err
+	}
+	return string(p), nil
+}
+
+// Prompt for a single line of visible input on the controlling terminal.
+func promptLine(prompt string) (string, error) {
+	t, err := openTerminal()
+	if err != nil {
+		return "", err
+	}
+	defer t.Close()
+
+	fmt.Fprintf(t, "%s", prompt)
+	return readLine(t)
+}
+
+func openControllingTerminal() (terminalIO, error) {
+	t, err := openTTY()
+	if err != nil {
+		return nil, fmt.Errorf("no controlling terminal available to prompt for credentials: %s", err)
+	}
+	if !terminal.IsTerminal(int(t.in.Fd())) {
+		t.Close()
+		return nil, errors.New("no controlling terminal available to prompt for credentials")
+	}
+	return t, nil
+}
+
+// Read a single line a byte at a time so that nothing beyond the newline is consumed
+// before the terminal is switched to raw mode to read the password.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF && len(line) > 0 {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSpace(string(line)), nil
+}
+
+// Username to use without prompting, taken from -username or, if requested, $USER.
+func defaultUsername() string {
+	if cfg.username != "" {
+		return cfg.username
+	}
+	if cfg.useOSUsername {
+		return os.Getenv("USER")
+	}
+	return ""
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Proxy selection for token endpoint requests. Without -proxy the standard HTTPS_PROXY,
+// HTTP_PROXY and NO_PROXY environment variables are used. An explicit proxy is bypassed
+// for hosts matching -no-proxy, which defaults to $NO_PROXY.
+func proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	if cfg.proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	proxyURL, err := url.Parse(cfg.proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	noProxy := cfg.noProxy
+	if noProxy == "" {
+		noProxy = getEnvAny("NO_PROXY", "no_proxy")
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL.Hostname(), noProxy) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}, nil
+}
+
+// Report whether host matches the comma separated NO_PROXY style list. Entries may be
+// "*", an IP address, a CIDR range or a domain, which also matches its subdomains.
+func bypassProxy(host, noProxy string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		if entryIP := net.ParseIP(entry); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		entry = strings.TrimPrefix(entry, "*")
+		entry = strings.TrimPrefix(entry, ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+func getEnvAny(names ...string) string {
+	for _, n := range names {
+		if v := os.Getenv(n); v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestBypassProxy(t *testing.T) {
+	tests := []struct {
+		host    string
+		noProxy string
+		want    bool
+	}{
+		{"token.example.com", "", false},
+		{"token.example.com", "*", true},
+		{"token.example.com", "example.com", true},
+		{"token.example.com", ".example.com", true},
+		{"token.example.com", "*.example.com", true},
+		{"example.com", ".example.com", true},
+		{"badexample.com", "example.com", false},
+		{"example.com.evil.net", "example.com", false},
+		{"TOKEN.Example.COM", "example.com", true},
+		{"token.example.com", " other.com , example.com ", true},
+		{"token.example.com", "example.com:8443", true},
+		{"10.1.2.3", "10.0.0.0/8", true},
+		{"192.168.1.1", "10.0.0.0/8", false},
+		{"10.1.2.3", "10.1.2.3", true},
+		{"10.1.2.3", "10.1.2.4", false},
+		{"::1", "::1", true},
+		{"::1", "[::1]:443", true},
+		{"fd00::1", "fd00::/8", true},
+		{"token.example.com", "10.0.0.0/8", false},
+		{"token.example.com", ",,", false},
+	}
+	for _, test := range tests {
+		if got := bypassProxy(test.host, test.noProxy); got != test.want {
+			t.Errorf("bypassProxy(%q, %q) = %t, want %t", test.host, test.noProxy, got, test.want)
+		}
+	}
+}
+
+func TestProxyFunc(t *testing.T) {
+	cfg = config{proxy: "http://proxy.example.com:3128", noProxy: "internal.example.com"}
+	defer func() { cfg = config{} }()
+
+	proxy, err := proxyFunc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]string{
+		"token.example.com":    "http://proxy.example.com:3128",
+		"internal.example.com": "",
+	} {
+		req, _ := http.NewRequest("GET", "https://"+host+"/ldapAuth", nil)
+		u, err := proxy(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if u != nil {
+			got = u.String()
+		}
+		if got != want {
+			t.Errorf("proxy for %s = %q, want %q", host, got, want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Overridden to avoid waiting when exercising retries.
+var sleep = time.Sleep
+
+// Send a request, retrying with exponential backoff and full jitter when the server
+// responds with 429 or 503, honouring Retry-After. Transport errors and other 5xx
+// responses are only retried if the request is idempotent, as is the case for reviews.
+// newRequest is called for every attempt so that request bodies can be replayed.
+func doWithRetry(client *http.Client, newRequest func() (*http.Request, error), idempotent bool) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := client.Do(req)
+		if attempt >= cfg.maxRetries || !shouldRetry(resp, err, idempotent) {
+			return resp, err
+		}
+
+		delay := backoff(attempt)
+		if resp != nil {
+			if d, ok := retryAfter(resp); ok {
+				delay = d
+			}
+			resp.Body.Close()
+		}
+		if delay > cfg.retryMaxDelay {
+			delay = cfg.retryMaxDelay
+		}
+		sleep(delay)
+	}
+}
+
+func shouldRetry(resp *http.Response, err error, idempotent bool) bool {
+	if err != nil {
+		return idempotent
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusServiceUnavailable:
+		return true
+	case resp.StatusCode >= 500:
+		return idempotent
+	}
+	return false
+}
+
+// Full jitter backoff, a random delay up to retry-delay doubled for every attempt.
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+func backoff(attempt int) time.Duration {
+	ceiling := cfg.retryDelay << uint(attempt)
+	if ceiling <= 0 || ceiling > cfg.retryMaxDelay {
+		ceiling = cfg.retryMaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// Parse Retry-After given as either a number of seconds or an HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
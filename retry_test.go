@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShouldRetry(t *testing.T) {
+	tests := []struct {
+		status     int
+		idempotent bool
+		want       bool
+	}{
+		{http.StatusOK, true, false},
+		{http.StatusUnauthorized, true, false},
+		{http.StatusTooManyRequests, false, true},
+		{http.StatusServiceUnavailable, false, true},
+		{http.StatusInternalServerError, true, true},
+		{http.StatusInternalServerError, false, false},
+		{http.StatusBadGateway, true, true},
+		{http.StatusBadGateway, false, false},
+		{http.StatusGatewayTimeout, true, true},
+	}
+	for _, test := range tests {
+		resp := &http.Response{StatusCode: test.status}
+		if got := shouldRetry(resp, nil, test.idempotent); got != test.want {
+			t.Errorf("shouldRetry(%d, idempotent %t) = %t, want %t", test.status, test.idempotent, got, test.want)
+		}
+	}
+	if !shouldRetry(nil, http.ErrHandlerTimeout, true) || shouldRetry(nil, http.ErrHandlerTimeout, false) {
+		t.Error("transport errors should only be retried when idempotent")
+	}
+}
+
+func TestDoWithRetry(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.Header().Set("Retry-After", "2")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}))
+	defer server.Close()
+
+	cfg = config{maxRetries: 3, retryDelay: time.Second, retryMaxDelay: 10 * time.Second}
+	defer func() { cfg = config{} }()
+	var delays []time.Duration
+	sleep = func(d time.Duration) { delays = append(delays, d) }
+	defer func() { sleep = func(time.Duration) {} }()
+
+	resp, err := doWithRetry(server.Client(), func() (*http.Request, error) {
+		return http.NewRequest("POST", server.URL, nil)
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || attempts != 3 {
+		t.Errorf("status %d after %d attempts, want 200 after 3", resp.StatusCode, attempts)
+	}
+	if len(delays) != 2 || delays[0] != 2*time.Second {
+		t.Errorf("delays = %v, want two of Retry-After 2s", delays)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{"", 0, false},
+		{"5", 5 * time.Second, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, true},
+	}
+	for _, test := range tests {
+		resp := &http.Response{Header: http.Header{"Retry-After": {test.header}}}
+		got, ok := retryAfter(resp)
+		if got != test.want || ok != test.ok {
+			t.Errorf("retryAfter(%q) = %s, %t, want %s, %t", test.header, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	cfg = config{retryDelay: time.Second, retryMaxDelay: 4 * time.Second}
+	defer func() { cfg = config{} }()
+	for attempt := 0; attempt < 40; attempt++ {
+		ceiling := time.Second << uint(attempt)
+		if attempt > 2 {
+			ceiling = 4 * time.Second
+		}
+		if d := backoff(attempt); d < 0 || d >= ceiling {
+			t.Errorf("backoff(%d) = %s, want under %s", attempt, d, ceiling)
+		}
+	}
+}
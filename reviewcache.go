@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mweigel/token-cache-plugin/tokencache"
+)
+
+// File within the cache directory remembering recent token review results.
+const reviewCacheFile = "reviews.json"
+
+// Result of reviewing a token, keyed in the review cache by the token's fingerprint so the
+// token itself isn't stored again.
+type cachedReview struct {
+	Authenticated bool      `json:"authenticated"`
+	User          k8suser   `json:"user"`
+	ReviewedAt    time.Time `json:"reviewedAt"`
+	// Expiry of the token, if known. A review is never trusted past it.
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+}
+
+func (r cachedReview) fresh(now time.Time) bool {
+	ttl := cfg.reviewCacheNegativeTTL
+	if r.Authenticated {
+		ttl = cfg.reviewCacheTTL
+	}
+	if !r.ExpiresAt.IsZero() && !now.Before(r.ExpiresAt) {
+		return false
+	}
+	return ttl > 0 && now.Sub(r.ReviewedAt) < ttl
+}
+
+// Review a token, using a cached result if the same token was reviewed within
+// review-cache-ttl, or review-cache-negative-ttl if it was rejected, and hasn't since
+// expired. This saves a round trip to the token review endpoint for every kubectl command
+// a script runs. Errors reviewing a token are never cached.
+func reviewTokenCached(client *http.Client, token []byte, now time.Time) (tokenReviewResponse, error) {
+	if cfg.reviewCacheTTL <= 0 && cfg.reviewCacheNegativeTTL <= 0 {
+		return reviewToken(client, token)
+	}
+
+	fingerprint := tokenFingerprint(token)
+	reviews := readReviewCache()
+	if r, ok := reviews[fingerprint]; ok && fingerprint != "" && r.fresh(now) {
+		record := auditRecord{Event: auditReview, Outcome: auditRejected, Fingerprint: fingerprint, Cached: true}
+		if r.Authenticated {
+			record.Outcome, record.Username = auditAuthenticated, r.User.Username
+		}
+		auditLog.record(record)
+		return tokenReviewResponse{Status: status{Authenticated: r.Authenticated, User: r.User}}, nil
+	}
+
+	res, err := reviewToken(client, token)
+	if err != nil || fingerprint == "" {
+		return res, err
+	}
+
+	// Drop stale results so the cache doesn't grow with every token ever issued.
+	for k, r := range reviews {
+		if !r.fresh(now) {
+			delete(reviews, k)
+		}
+	}
+	review := cachedReview{Authenticated: res.Status.Authenticated, User: res.Status.User, ReviewedAt: now}
+	if expiry, ok := tokencache.Expiry(token); ok {
+		review.ExpiresAt = expiry
+	}
+	reviews[fingerprint] = review
+	writeReviewCache(reviews)
+	return res, nil
+}
+
+// Forget any cached review of a token, such as when it's revoked.
+func forgetReview(token []byte) {
+	reviews := readReviewCache()
+	if _, ok := reviews[tokenFingerprint(token)]; ok {
+		delete(reviews, tokenFingerprint(token))
+		writeReviewCache(reviews)
+	}
+}
+
+func readReviewCache() map[string]cachedReview {
+	reviews := map[string]cachedReview{}
+	b, err := ioutil.ReadFile(filepath.Join(cfg.cacheDir, reviewCacheFile))
+	if err != nil {
+		return reviews
+	}
+	json.Unmarshal(b, &reviews)
+	return reviews
+}
+
+// Caching reviews is best effort, failing only means the next review isn't skipped.
+func writeReviewCache(reviews map[string]cachedReview) {
+	b, err := json.Marshal(reviews)
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(cfg.cacheDir, os.FileMode(0700)); err != nil {
+		return
+	}
+	writePrivateFile(filepath.Join(cfg.cacheDir, reviewCacheFile), b)
+}
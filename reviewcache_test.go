@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Token review endpoint authenticating or rejecting every token, counting reviews.
+func newReviewServer(t *testing.T, authenticated bool, reviews *int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*reviews++
+		fmt.Fprintf(w, `{"apiVersion":"authentication.k8s.io/v1beta1","kind":"TokenReview","status":{"authenticated":%t,"user":{"username":"jdoe"}}}`, authenticated)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestReviewTokenCached(t *testing.T) {
+	defer func() { cfg = config{} }()
+	dir, err := ioutil.TempDir("", "reviewcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now().Truncate(time.Second)
+	tests := []struct {
+		name          string
+		authenticated bool
+		expiry        time.Duration
+		// Times, relative to now, of each review and whether it should reach the endpoint.
+		at   []time.Duration
+		want []bool
+	}{
+		{
+			name:          "authenticated",
+			authenticated: true,
+			expiry:        time.Hour,
+			at:            []time.Duration{0, 30 * time.Second, 2 * time.Minute},
+			want:          []bool{true, false, true},
+		},
+		{
+			name:   "rejected",
+			expiry: time.Hour,
+			at:     []time.Duration{0, 5 * time.Second, 20 * time.Second},
+			want:   []bool{true, false, true},
+		},
+		{
+			name:          "expired",
+			authenticated: true,
+			expiry:        10 * time.Second,
+			at:            []time.Duration{0, 5 * time.Second, 10 * time.Second},
+			want:          []bool{true, false, true},
+		},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var reviews int
+			server := newReviewServer(t, test.authenticated, &reviews)
+			cfg = config{
+				tokenReviewEndpoints:   stringSlice{server.URL},
+				cacheDir:               filepath.Join(dir, strconv.Itoa(i)),
+				reviewCacheTTL:         time.Minute,
+				reviewCacheNegativeTTL: 10 * time.Second,
+			}
+			token := testJWT(now.Add(test.expiry))
+
+			for j, at := range test.at {
+				before := reviews
+				res, err := reviewTokenCached(server.Client(), token, now.Add(at))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.Status.Authenticated != test.authenticated {
+					t.Errorf("review %d authenticated = %t, want %t", j, res.Status.Authenticated, test.authenticated)
+				}
+				if reviewed := reviews > before; reviewed != test.want[j] {
+					t.Errorf("review %d at %s reached the endpoint = %t, want %t", j, at, reviewed, test.want[j])
+				}
+			}
+		})
+	}
+}
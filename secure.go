@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/mweigel/token-cache-plugin/tokencache"
+)
+
+// How insecure cache files are handled, mirroring ssh's StrictModes.
+const (
+	// Tighten the permissions of cache files readable by others, refuse anything else.
+	strictModesRepair = "repair"
+	// Refuse to use any insecure cache file.
+	strictModesRefuse = "refuse"
+	// Don't check cache files.
+	strictModesOff = "off"
+)
+
+// Reason a cache file can't be trusted. Only permissions that are too open can be repaired,
+// a file owned by someone else, a symlink or an insecure directory can't be.
+type fileProblem struct {
+	msg        string
+	repairable bool
+}
+
+// Check a cache file, and every directory above it, the way ssh's StrictModes checks
+// authorized_keys. The file must not be a symlink, must be owned by the current user and
+// must not be accessible to others. Directories must be owned by the current user or root
+// and must not be writable by others unless the sticky bit is set, as on /tmp. Ownership
+// and permissions aren't checked on Windows, where access is controlled by ACLs.
+func checkFileSecurity(path string) ([]fileProblem, error) {
+	if runtime.GOOS == "windows" {
+		return nil, nil
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	return append(checkFileInfo(path, info), checkDirSecurity(filepath.Dir(path))...), nil
+}
+
+// Check a cache file itself, without the directories above it.
+func checkFileInfo(path string, info os.FileInfo) []fileProblem {
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		return []fileProblem{{msg: fmt.Sprintf("%s is a symlink", path)}}
+	case !info.Mode().IsRegular() && !info.IsDir():
+		return []fileProblem{{msg: fmt.Sprintf("%s is not a regular file", path)}}
+	}
+	var problems []fileProblem
+	if uid, ok := fileOwner(info); ok && uid != os.Getuid() {
+		problems = append(problems, fileProblem{msg: fmt.Sprintf("%s is owned by uid %d, not the current user", path, uid)})
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		problems = append(problems, fileProblem{msg: fmt.Sprintf("%s has mode %s and is accessible to other users", path, info.Mode().Perm()), repairable: true})
+	}
+	return problems
+}
+
+func checkDirSecurity(dir string) []fileProblem {
+	var problems []fileProblem
+	for {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return append(problems, fileProblem{msg: err.Error()})
+		}
+		if uid, ok := fileOwner(info); ok && uid != os.Getuid() && uid != 0 {
+			problems = append(problems, fileProblem{msg: fmt.Sprintf("directory %s is owned by uid %d, not the current user or root", dir, uid)})
+		}
+		if info.Mode().Perm()&0022 != 0 && info.Mode()&os.ModeSticky == 0 {
+			problems = append(problems, fileProblem{msg: fmt.Sprintf("directory %s has mode %s and is writable by other users without the sticky bit", dir, info.Mode().Perm())})
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return problems
+		}
+		dir = parent
+	}
+}
+
+// Make an open cache file safe to use according to -strict-modes, repairing permissions if
+// allowed. The file is checked through the open descriptor so that it can't be replaced
+// after it's checked. Returns an error describing the first problem that prevents the file
+// being used.
+func secureCacheFile(f *os.File, logger *leveledLogger) error {
+	if cfg.strictModes == strictModesOff || runtime.GOOS == "windows" {
+		return nil
+	}
+	path, err := filepath.Abs(f.Name())
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	problems := append(checkFileInfo(path, info), checkDirSecurity(filepath.Dir(path))...)
+	for _, p := range problems {
+		if !p.repairable || cfg.strictModes != strictModesRepair {
+			return fmt.Errorf("refusing to use %s: %s", path, p.msg)
+		}
+		if err = f.Chmod(os.FileMode(0600)); err != nil {
+			return fmt.Errorf("refusing to use %s: %s", path, p.msg)
+		}
+		logger.Warnf("Repaired %s, %s\n", path, p.msg)
+	}
+	return nil
+}
+
+// Read a cached token once the file has been checked. Unless strict modes are off the file
+// is opened without following symlinks.
+func readCachedToken(path string, logger *leveledLogger) ([]byte, error) {
+	flag := os.O_RDONLY
+	if cfg.strictModes != strictModesOff {
+		flag |= openNoFollow
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if isSymlinkError(err) {
+		return nil, fmt.Errorf("refusing to use %s: %s is a symlink", path, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err = secureCacheFile(f, logger); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(f)
+}
+
+// Write a file readable only by the current user, refusing if others could tamper with
+// the directory it's written to.
+func writePrivateFile(path string, data []byte) error {
+	if err := checkWritableDir(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("refusing to write %s: %s", path, err)
+	}
+	return tokencache.WritePrivateFile(path, data)
+}
+
+// Check a directory files are written to, unless strict modes are off.
+func checkWritableDir(dir string) error {
+	if cfg.strictModes == strictModesOff || runtime.GOOS == "windows" {
+		return nil
+	}
+	if problems := checkDirSecurity(dir); len(problems) > 0 {
+		return errors.New(problems[0].msg)
+	}
+	return nil
+}
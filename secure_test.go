@@ -0,0 +1,130 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadCachedToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { cfg = config{} }()
+	logger := newLogger(ioutil.Discard, levelError, false)
+
+	tests := []struct {
+		name     string
+		mode     os.FileMode
+		symlink  bool
+		strict   string
+		wantErr  string
+		wantMode os.FileMode
+	}{
+		{"private", 0600, false, strictModesRefuse, "", 0600},
+		{"readable repaired", 0644, false, strictModesRepair, "", 0600},
+		{"readable refused", 0644, false, strictModesRefuse, "accessible to other users", 0644},
+		{"readable unchecked", 0644, false, strictModesOff, "", 0644},
+		{"symlink refused", 0600, true, strictModesRepair, "symlink", 0600},
+		{"symlink unchecked", 0600, true, strictModesOff, "", 0600},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg = config{strictModes: test.strict}
+			target := filepath.Join(dir, strings.Replace(test.name, " ", "-", -1))
+			if err := ioutil.WriteFile(target, []byte("token"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(target, test.mode); err != nil {
+				t.Fatal(err)
+			}
+			path := target
+			if test.symlink {
+				path = target + "-link"
+				if err := os.Symlink(target, path); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			token, err := readCachedToken(path, logger)
+			if test.wantErr == "" {
+				if err != nil || string(token) != "token" {
+					t.Errorf("readCachedToken = %q, %v, want the token", token, err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("readCachedToken error = %v, want %q", err, test.wantErr)
+			}
+			if info, err := os.Stat(target); err != nil || info.Mode().Perm() != test.wantMode {
+				t.Errorf("mode = %v, %v, want %s", info.Mode().Perm(), err, test.wantMode)
+			}
+		})
+	}
+}
+
+func TestCheckWritableDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { cfg = config{} }()
+
+	cfg = config{strictModes: strictModesRefuse}
+	if err = checkWritableDir(dir); err != nil {
+		t.Errorf("private directory refused: %s", err)
+	}
+	if err = os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkWritableDir(dir); err == nil {
+		t.Error("world writable directory accepted")
+	}
+	if err = writePrivateFile(filepath.Join(dir, "token"), []byte("token")); err == nil {
+		t.Error("wrote to a world writable directory")
+	}
+	if err = os.Chmod(dir, 0777|os.ModeSticky); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkWritableDir(dir); err != nil {
+		t.Errorf("sticky directory refused: %s", err)
+	}
+	cfg = config{strictModes: strictModesOff}
+	if err = os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkWritableDir(dir); err != nil {
+		t.Errorf("directory refused with strict modes off: %s", err)
+	}
+}
+
+func TestCheckCacheFileHint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "token")
+	if err = ioutil.WriteFile(file, []byte("token"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sub := filepath.Join(dir, "cache")
+	if err = os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{file: "hint: chmod 600 " + file, sub: "hint: chmod 700 " + sub} {
+		var b bytes.Buffer
+		checkCacheFile(&doctorReport{w: &b}, "cache", path)
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("report = %q, want %q", b.String(), want)
+		}
+	}
+}
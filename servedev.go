@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/mweigel/token-cache-plugin/devserver"
+)
+
+// Run the reference token service, for trying the plugin without kubernetes-ldap.
+func serveDev(logger *leveledLogger) {
+	if cfg.devUsers == "" {
+		logger.Fatalf("serve-dev requires -dev-users\n")
+	}
+	users, err := devserver.ReadUsers(cfg.devUsers)
+	if err != nil {
+		logger.Fatalf("Error reading users: %s\n", err)
+	}
+
+	server := devserver.New(devserver.Config{
+		Users:         users,
+		TokenTTL:      cfg.devTokenTTL,
+		Latency:       cfg.devLatency,
+		ErrorRate:     cfg.devErrorRate,
+		ErrorStatus:   cfg.devErrorStatus,
+		MalformedRate: cfg.devMalformedRate,
+	})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger.Debugf("%s %s\n", r.Method, r.URL.Path)
+		server.ServeHTTP(w, r)
+	})
+
+	listener, err := listen(cfg.listen)
+	if err != nil {
+		logger.Fatalf("Error listening on %s: %s\n", cfg.listen, err)
+	}
+	scheme := "http"
+	if cfg.devTLSCert != "" {
+		scheme = "https"
+	}
+	logger.Infof("Serving %d users, token request endpoint %s://%s%s, token review endpoint %s://%s%s\n",
+		len(users), scheme, listener.Addr(), devserver.RequestPath, scheme, listener.Addr(), devserver.ReviewPath)
+
+	if cfg.devTLSCert != "" {
+		err = http.ServeTLS(listener, handler, cfg.devTLSCert, cfg.devTLSKey)
+	} else {
+		err = http.Serve(listener, handler)
+	}
+	logger.Fatalf("Error serving: %s\n", err)
+}
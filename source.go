@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/mweigel/token-cache-plugin/tokencache"
+)
+
+// Acquires tokens, reusing the cached token while it's valid and otherwise prompting for
+// credentials and requesting a new one. Shared by every way the plugin hands out tokens.
+type tokenSource struct {
+	requestClient *http.Client
+	reviewClient  *http.Client
+	logger        *leveledLogger
+}
+
+func newTokenSource(logger *leveledLogger) (*tokenSource, error) {
+	requestClient, reviewClient, err := getHTTPClients(logger)
+	if err != nil {
+		return nil, fmt.Errorf("creating HTTP client: %s", err)
+	}
+	return &tokenSource{requestClient: requestClient, reviewClient: reviewClient, logger: logger}, nil
+}
+
+// Return a valid token and the user it belongs to. The user may be incomplete if the token
+// hasn't been reviewed, such as when it's just been issued or is being used offline.
+func (s *tokenSource) token() ([]byte, k8suser, error) {
+	logger := s.logger
+
+	// Attempt to read and use a previously cached token before prompting for a username and password.
+	token, err := readCachedToken(cfg.tokenPath, logger)
+	if os.IsNotExist(err) {
+		logger.Debugf("No cached token: %s\n", err)
+	} else if err != nil {
+		logger.Warnf("Ignoring cached token: %s\n", err)
+	}
+	logger.addSecret(string(token))
+
+	// If the token can't be reviewed because the review endpoint is down, rather than rejected,
+	// keep using it during the offline grace period instead of forcing a login that would likely fail.
+	// There's nothing to review if no token is cached.
+	if len(token) > 0 {
+		tokenResponse, err := reviewTokenCached(s.reviewClient, token, time.Now())
+		offline := false
+		if err != nil {
+			logger.Warnf("Error reviewing cached token: %s\n", err)
+			offline = isUnreachable(err) && withinOfflineGrace(token, time.Now(), logger)
+		}
+		logger.Debugf("Cached token authenticated: %t\n", tokenResponse.Status.Authenticated)
+		if tokenResponse.Status.Authenticated || offline {
+			if tokenResponse.Status.Authenticated {
+				localCache().MarkReviewed(cfg.tokenPath, time.Now())
+			}
+			auditLog.record(auditRecord{Event: auditCache, Outcome: auditHit, Username: tokenResponse.Status.User.Username, Fingerprint: tokenFingerprint(token)})
+			return token, tokenResponse.Status.User, nil
+		}
+	}
+	auditLog.record(auditRecord{Event: auditCache, Outcome: auditMiss, Fingerprint: tokenFingerprint(token)})
+
+	// The username identifies whose failed logins to check before prompting for a password.
+	username, password := defaultUsername(), ""
+	if !cfg.clientCertOnly && username == "" {
+		if username, err = promptLine("username: "); err != nil {
+			return nil, k8suser{}, fmt.Errorf("reading credentials: %s", err)
+		}
+	}
+	identity := loginIdentity(username)
+	if err = throttleLogin(identity, time.Now(), logger); err != nil {
+		return nil, k8suser{}, fmt.Errorf("requesting token: %s", err)
+	}
+
+	if !cfg.clientCertOnly {
+		if err = readCredentials(&username, &password); err != nil {
+			return nil, k8suser{}, fmt.Errorf("reading credentials: %s", err)
+		}
+		logger.addSecret(password)
+	}
+	otp, err := readOTP()
+	if err != nil {
+		return nil, k8suser{}, fmt.Errorf("reading one time password: %s", err)
+	}
+	logger.addSecret(otp)
+
+	if token, err = requestToken(s.requestClient, username, password, otp); err != nil {
+		if isAuthFailure(err) {
+			if ferr := recordLoginFailure(identity, time.Now()); ferr != nil {
+				logger.Warnf("Error recording failed login: %s\n", ferr)
+			}
+		}
+		return nil, k8suser{}, fmt.Errorf("requesting token: %s", err)
+	}
+	if err = clearLoginFailures(identity); err != nil {
+		logger.Warnf("Error clearing failed logins: %s\n", err)
+	}
+	logger.addSecret(string(token))
+	logger.Debugf("Requested token for %s\n", username)
+
+	// Write token to file to be used next time kubectl is run unless caching is disabled.
+	if cfg.cacheTokens {
+		entry := tokencache.Entry{Endpoint: readLastEndpoints()[requestEndpoint], Username: username, LastReviewed: time.Now()}
+		if err = localCache().Store(cfg.tokenPath, token, entry); err != nil {
+			logger.Warnf("Error caching token: %s\n", err)
+		}
+	}
+	return token, k8suser{Username: username}, nil
+}
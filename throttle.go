@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mweigel/token-cache-plugin/tokencache"
+)
+
+// File within the cache directory recording consecutive failed logins per identity.
+const loginFailuresFile = "login-failures.json"
+
+// Longest delay before a login after previous failures.
+const maxLoginBackoff = 30 * time.Second
+
+// How long to wait for the lock on login-failures.json, and when a lock is assumed to have
+// been left behind.
+const (
+	lockTimeout  = 5 * time.Second
+	staleLockAge = 10 * time.Second
+)
+
+// Whether a token request failed because the token request endpoint rejected the credentials.
+func isAuthFailure(err error) bool {
+	return errors.Is(err, tokencache.ErrBadCredentials)
+}
+
+type loginFailures struct {
+	Count       int       `json:"count"`
+	LastFailure time.Time `json:"lastFailure"`
+}
+
+// Identity failures are counted against, the same username may have separate accounts
+// behind different token request endpoints.
+func loginIdentity(username string) string {
+	return username + "@" + strings.Join(cfg.tokenRequestEndpoints, ",")
+}
+
+func readLoginFailures() map[string]loginFailures {
+	failures := map[string]loginFailures{}
+	b, err := ioutil.ReadFile(filepath.Join(cfg.cacheDir, loginFailuresFile))
+	if err != nil {
+		return failures
+	}
+	json.Unmarshal(b, &failures)
+	return failures
+}
+
+func writeLoginFailures(failures map[string]loginFailures) error {
+	b, err := json.Marshal(failures)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(cfg.cacheDir, os.FileMode(0700)); err != nil {
+		return err
+	}
+	return writePrivateFile(filepath.Join(cfg.cacheDir, loginFailuresFile), b)
+}
+
+// Consecutive failed logins for an identity, ignoring failures older than the window
+// after which directory services typically reset their own lockout counters.
+func recentLoginFailures(identity string, now time.Time) loginFailures {
+	f := readLoginFailures()[identity]
+	if now.Sub(f.LastFailure) > cfg.loginFailureWindow {
+		return loginFailures{}
+	}
+	return f
+}
+
+// Guard against locking an account with repeated failed logins, whether from parallel
+// kubectl processes or a stale password. Logins are refused once max-login-failures is
+// reached, and otherwise delayed, doubling with each recent failure. This is checked before
+// prompting for a password so that a refused login doesn't ask for one.
+func throttleLogin(identity string, now time.Time, logger *leveledLogger) error {
+	if cfg.maxLoginFailures <= 0 {
+		return nil
+	}
+	f := recentLoginFailures(identity, now)
+	if f.Count == 0 {
+		return nil
+	}
+
+	if f.Count >= cfg.maxLoginFailures {
+		return fmt.Errorf("%d consecutive failed logins for %s, not trying again until %s to avoid locking the account, or remove %s",
+			f.Count, identity, f.LastFailure.Add(cfg.loginFailureWindow).Format(time.RFC3339), filepath.Join(cfg.cacheDir, loginFailuresFile))
+	}
+
+	delay := time.Second << uint(f.Count-1)
+	if delay <= 0 || delay > maxLoginBackoff {
+		delay = maxLoginBackoff
+	}
+	logger.Warnf("%d recent failed login(s) for %s, waiting %s before trying again\n", f.Count, identity, delay)
+	sleep(delay)
+	return nil
+}
+
+// Hold the lock on the failed login counts while they're updated, so that parallel kubectl
+// processes don't lose each other's failures. The lock is a file created exclusively, one
+// left behind by a process that died is broken once it's older than staleLockAge.
+func lockLoginFailures() (unlock func(), err error) {
+	if err = os.MkdirAll(cfg.cacheDir, os.FileMode(0700)); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(cfg.cacheDir, loginFailuresFile+".lock")
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(0600))
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for %s", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Count a failed login against an identity.
+func recordLoginFailure(identity string, now time.Time) error {
+	unlock, err := lockLoginFailures()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	failures := readLoginFailures()
+	f := recentLoginFailures(identity, now)
+	failures[identity] = loginFailures{Count: f.Count + 1, LastFailure: now}
+	return writeLoginFailures(failures)
+}
+
+// Reset the failed login count after a successful login.
+func clearLoginFailures(identity string) error {
+	if _, ok := readLoginFailures()[identity]; !ok {
+		return nil
+	}
+	unlock, err := lockLoginFailures()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	failures := readLoginFailures()
+	delete(failures, identity)
+	return writeLoginFailures(failures)
+}
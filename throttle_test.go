@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mweigel/token-cache-plugin/devserver"
+)
+
+func TestThrottleLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "throttle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg = config{cacheDir: dir, maxLoginFailures: 3, loginFailureWindow: 30 * time.Minute}
+	defer func() { cfg = config{} }()
+	var delays []time.Duration
+	sleep = func(d time.Duration) { delays = append(delays, d) }
+	defer func() { sleep = func(time.Duration) {} }()
+	logger := newLogger(ioutil.Discard, levelError, false)
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if err = throttleLogin("jdoe", now, logger); err != nil {
+			t.Fatalf("login refused after %d failures: %s", i, err)
+		}
+		if err = recordLoginFailure("jdoe", now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []time.Duration{time.Second, 2 * time.Second}; len(delays) != 2 || delays[0] != want[0] || delays[1] != want[1] {
+		t.Errorf("delays = %v, want %v", delays, want)
+	}
+	if err = throttleLogin("jdoe", now, logger); err == nil {
+		t.Error("login allowed after 3 failures")
+	}
+	if err = throttleLogin("other", now, logger); err != nil {
+		t.Errorf("another identity was refused: %s", err)
+	}
+	if err = throttleLogin("jdoe", now.Add(time.Hour), logger); err != nil {
+		t.Errorf("login refused after the failure window: %s", err)
+	}
+
+	if err = clearLoginFailures("jdoe"); err != nil {
+		t.Fatal(err)
+	}
+	if err = throttleLogin("jdoe", now, logger); err != nil {
+		t.Errorf("login refused after clearing failures: %s", err)
+	}
+}
+
+func TestRecordLoginFailureConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "throttle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg = config{cacheDir: dir, loginFailureWindow: 30 * time.Minute}
+	defer func() { cfg = config{} }()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := recordLoginFailure("jdoe", time.Now()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if f := recentLoginFailures("jdoe", time.Now()); f.Count != 20 {
+		t.Errorf("count = %d, want 20", f.Count)
+	}
+}
+
+func TestLoginRefusedBeforePrompting(t *testing.T) {
+	e := newTestEnv(t, devserver.Config{})
+	for i := 0; i < 3; i++ {
+		if r := e.run("jdoe\nwrong\n"); r.code == 0 {
+			t.Fatal("login with the wrong password succeeded")
+		}
+	}
+
+	r := e.run("jdoe\nsecret\n")
+	if r.code == 0 {
+		t.Fatal("login allowed after 3 failures")
+	}
+	if strings.Contains(r.terminal, "password: ") {
+		t.Errorf("terminal = %q, want no password prompt", r.terminal)
+	}
+	if !strings.Contains(r.stderr, "consecutive failed logins") {
+		t.Errorf("stderr = %q, want the login refused", r.stderr)
+	}
+}
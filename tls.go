@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// TLS settings used when connecting to a token endpoint. Settings can be given for both
+// endpoints and overridden for the request or review endpoint individually.
+type tlsSettings struct {
+	caCerts             stringSlice
+	serverName          string
+	clientCert          string
+	clientKey           string
+	clientPKCS12        string
+	minVersion          string
+	pins                stringSlice
+	skipTLSVerification optionalBool
+}
+
+// Register flags for a set of TLS settings. Prefix is prepended to each flag name and
+// endpoint describes which endpoints the settings apply to.
+func registerTLSFlags(fs *flag.FlagSet, s *tlsSettings, prefix, endpoint string) {
+	fs.Var(&s.caCerts, prefix+"ca-cert", fmt.Sprintf("Path to CA certificate, bundle or directory of certificates used to verify %s, may be repeated", endpoint))
+	fs.StringVar(&s.serverName, prefix+"server-name", "", fmt.Sprintf("Server name used to verify the certificate presented by %s", endpoint))
+	fs.StringVar(&s.clientCert, prefix+"client-cert", "", fmt.Sprintf("Path to PEM encoded client certificate presented to %s", endpoint))
+	fs.StringVar(&s.clientKey, prefix+"client-key", "", fmt.Sprintf("Path to PEM encoded private key for -%sclient-cert", prefix))
+	fs.StringVar(&s.clientPKCS12, prefix+"client-pkcs12", "", fmt.Sprintf("Path to PKCS#12 bundle containing the client certificate and private key presented to %s", endpoint))
+	fs.StringVar(&s.minVersion, prefix+"min-tls-version", "", fmt.Sprintf("Minimum TLS version used to connect to %s, one of 1.0, 1.1, 1.2 or 1.3", endpoint))
+	fs.Var(&s.pins, prefix+"pin-sha256", fmt.Sprintf("Base64 SHA-256 hash of a public key one of the certificates presented by %s must match, may be repeated", endpoint))
+	fs.Var(&s.skipTLSVerification, prefix+"skip-tls-verification", fmt.Sprintf("Skip TLS verification of certificates presented by %s", endpoint))
+}
+
+// Combine endpoint specific settings with those applying to both endpoints. Endpoint
+// specific settings take precedence. A client certificate is overridden as a whole.
+func (s tlsSettings) merge(defaults tlsSettings) tlsSettings {
+	if len(s.caCerts) == 0 {
+		s.caCerts = defaults.caCerts
+	}
+	if s.serverName == "" {
+		s.serverName = defaults.serverName
+	}
+	if s.clientCert == "" && s.clientKey == "" && s.clientPKCS12 == "" {
+		s.clientCert, s.clientKey, s.clientPKCS12 = defaults.clientCert, defaults.clientKey, defaults.clientPKCS12
+	}
+	if s.minVersion == "" {
+		s.minVersion = defaults.minVersion
+	}
+	if len(s.pins) == 0 {
+		s.pins = defaults.pins
+	}
+	if !s.skipTLSVerification.set {
+		s.skipTLSVerification = defaults.skipTLSVerification
+	}
+	return s
+}
+
+// Create a client for a token endpoint. Requests are traced if the log level allows.
+func getHTTPClient(s tlsSettings, logger *leveledLogger) (*http.Client, error) {
+	tlsConfig, err := getTLSConfig(s)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := proxyFunc()
+	if err != nil {
+		return nil, err
+	}
+
+	var transport http.RoundTripper = &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: cfg.tlsHandshakeTimeout,
+		TLSClientConfig:     tlsConfig,
+	}
+	if logger.enabled(levelTrace) {
+		transport = &tracingTransport{next: transport, logger: logger}
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   cfg.timeout,
+	}
+
+	return client, nil
+}
+
+func getTLSConfig(s tlsSettings) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: s.skipTLSVerification.value,
+		ServerName:         s.serverName,
+	}
+
+	if s.minVersion != "" {
+		version, err := parseTLSVersion(s.minVersion)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if len(s.caCerts) > 0 {
+		caCertPool, err := loadCertPool(s.caCerts)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	if err := pinPublicKeys(tlsConfig, s.pins); err != nil {
+		return nil, err
+	}
+
+	cert, err := loadClientCertificate(s)
+	if err != nil {
+		return nil, err
+	}
+	if cert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// Build a certificate pool from PEM encoded certificates. Each path may be a single
+// certificate, a bundle or a directory, in which case every file within it is loaded.
+func loadCertPool(paths []string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			if err = appendCertsFromFile(pool, path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		loaded := 0
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			if appendCertsFromFile(pool, filepath.Join(path, f.Name())) == nil {
+				loaded++
+			}
+		}
+		if loaded == 0 {
+			return nil, fmt.Errorf("no certificates found in %s", path)
+		}
+	}
+	return pool, nil
+}
+
+func appendCertsFromFile(pool *x509.CertPool, path string) error {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in %s", path)
+	}
+	return nil
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", version)
+}
+
+// Boolean flag which records whether it was set, allowing an unset endpoint specific
+// flag to fall back to the setting for both endpoints.
+type optionalBool struct {
+	set   bool
+	value bool
+}
+
+func (b *optionalBool) String() string {
+	return strconv.FormatBool(b.value)
+}
+
+func (b *optionalBool) Set(value string) error {
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return errors.New("parse error")
+	}
+	b.set, b.value = true, v
+	return nil
+}
+
+func (b *optionalBool) IsBoolFlag() bool {
+	return true
+}
@@ -0,0 +1,184 @@
+package tokencache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// IndexFile is the file within the cache directory indexing cached tokens, which may be
+// spread across several token paths, for example one per cluster.
+const IndexFile = "index.json"
+
+// FileBackend is the storage backend of cached tokens. Tokens are only cached in files for now.
+const FileBackend = "file"
+
+// Entry is metadata about a cached token, the token itself is stored at Path.
+type Entry struct {
+	Path     string    `json:"path"`
+	Endpoint string    `json:"endpoint,omitempty"`
+	Username string    `json:"username,omitempty"`
+	CachedAt time.Time `json:"cachedAt"`
+	Backend  string    `json:"backend"`
+	// When the token was last authenticated by the token review endpoint.
+	LastReviewed time.Time `json:"lastReviewed,omitempty"`
+}
+
+// Key returns a short, stable key identifying the token cached at path.
+func Key(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// Cache of tokens in the same format as token-cache-plugin, so that tokens are shared
+// between the plugin and programs using this package.
+type Cache struct {
+	// Directory holding the index, ~/.k8s-token-cache for the plugin.
+	Dir string
+	// Path of the token file in use, ~/.k8s-last-token for the plugin.
+	TokenPath string
+	// Called before writing into a directory, if set, to refuse to write where others could
+	// tamper with the files.
+	CheckDir func(dir string) error
+}
+
+// ReadIndex reads the cache index, keyed by Key. The token path is included even if it
+// isn't indexed, as it may have been cached by an earlier version.
+func (c *Cache) ReadIndex() (map[string]Entry, error) {
+	index := map[string]Entry{}
+	b, err := ioutil.ReadFile(filepath.Join(c.Dir, IndexFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err = json.Unmarshal(b, &index); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.TokenPath != "" {
+		key := Key(c.TokenPath)
+		if _, ok := index[key]; !ok {
+			if info, err := os.Stat(c.TokenPath); err == nil {
+				index[key] = Entry{Path: c.TokenPath, CachedAt: info.ModTime(), Backend: FileBackend}
+			}
+		}
+	}
+	return index, nil
+}
+
+// WriteIndex replaces the cache index.
+func (c *Cache) WriteIndex(index map[string]Entry) error {
+	b, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(c.Dir, os.FileMode(0700)); err != nil {
+		return err
+	}
+	return c.writeFile(filepath.Join(c.Dir, IndexFile), b)
+}
+
+// Store writes a token to path and records it in the cache index.
+func (c *Cache) Store(path string, token []byte, entry Entry) error {
+	if err := c.writeFile(path, token); err != nil {
+		return err
+	}
+
+	index, err := c.ReadIndex()
+	if err != nil {
+		return err
+	}
+	entry.Path = path
+	entry.Backend = FileBackend
+	if entry.CachedAt.IsZero() {
+		entry.CachedAt = time.Now()
+	}
+	index[Key(path)] = entry
+	return c.WriteIndex(index)
+}
+
+// MarkReviewed records that the token cached at path was authenticated by the token
+// review endpoint. This is best effort as it only affects whether the token can be used offline.
+func (c *Cache) MarkReviewed(path string, now time.Time) {
+	index, err := c.ReadIndex()
+	if err != nil {
+		return
+	}
+	entry, ok := index[Key(path)]
+	if !ok {
+		return
+	}
+	entry.LastReviewed = now
+	index[Key(path)] = entry
+	c.WriteIndex(index)
+}
+
+// Remove removes a cached token and its index entry.
+func (c *Cache) Remove(index map[string]Entry, key string) error {
+	entry := index[key]
+	if err := os.Remove(entry.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(index, key)
+	return c.WriteIndex(index)
+}
+
+func (c *Cache) writeFile(path string, data []byte) error {
+	if c.CheckDir != nil {
+		if err := c.CheckDir(filepath.Dir(path)); err != nil {
+			return fmt.Errorf("refusing to write %s: %s", path, err)
+		}
+	}
+	return WritePrivateFile(path, data)
+}
+
+// ReadPrivateFile reads a file written by WritePrivateFile, refusing to follow a symlink or to
+// read a file owned by another user or accessible to others. The file is checked through the
+// open descriptor, so it can't be replaced once checked.
+func ReadPrivateFile(path string) ([]byte, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|openNoFollow, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("tokencache: %s is not a regular file", path)
+	}
+	if err = checkPrivate(path, info); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(f)
+}
+
+// WritePrivateFile writes a file readable only by the current user. The file is written
+// alongside path and renamed into place, so an existing file's looser permissions aren't
+// kept and a symlink at path is replaced rather than followed.
+func WritePrivateFile(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err = f.Chmod(os.FileMode(0600)); err == nil {
+		_, err = f.Write(data)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
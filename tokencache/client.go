@@ -0,0 +1,327 @@
+// Package tokencache acquires Kubernetes bearer tokens from a kubernetes-ldap style token
+// service, sharing the cached token with token-cache-plugin so that users log in once
+// for both kubectl and programs using this package.
+package tokencache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrNoToken is returned when there's no valid cached token and the Client has no
+// credentials to request one with.
+var ErrNoToken = errors.New("tokencache: no valid cached token")
+
+// ErrBadCredentials is wrapped by errors returned when the token request endpoint rejects
+// the credentials.
+var ErrBadCredentials = errors.New("tokencache: token request endpoint rejected credentials")
+
+// ErrUnreachable is wrapped by errors reviewing a token when no token review endpoint could
+// be reached or gave an answer, as opposed to the token being rejected.
+var ErrUnreachable = errors.New("tokencache: token review endpoint unreachable")
+
+// Kinds of token service endpoint, passed to Client.Send and reported in AuditEvents.
+const (
+	RequestEndpoint = "request"
+	ReviewEndpoint  = "review"
+)
+
+// Headers used by the token request endpoint to issue a challenge alongside a 401 and by
+// the client to answer it. The optional state header is echoed back unchanged.
+const (
+	ChallengeHeader         = "X-Auth-Challenge"
+	ChallengeStateHeader    = "X-Auth-Challenge-State"
+	ChallengeResponseHeader = "X-Auth-Challenge-Response"
+)
+
+// Most challenges answered before a token request is treated as failed.
+const maxChallengeRounds = 3
+
+// AuditEvent describes a token request or review, see Client.Audit.
+type AuditEvent struct {
+	// RequestEndpoint or ReviewEndpoint.
+	Kind string
+	// URL of the endpoint that answered, if any did.
+	Endpoint string
+	// User a token was requested for, or that a review authenticated.
+	Username string
+	// Token issued or reviewed, nil if none was issued.
+	Token []byte
+	// Whether a review authenticated the token.
+	Authenticated bool
+	Err           error
+}
+
+// Client acquires tokens, reusing the cached token while the token review endpoint
+// authenticates it and otherwise requesting a new one. It's safe for concurrent use.
+type Client struct {
+	// Token request endpoint, called with basic auth to issue a token.
+	RequestURL string
+	// Token review endpoint, sent a TokenReview of the cached token.
+	ReviewURL string
+	// Client used for both endpoints, http.DefaultClient if nil.
+	HTTPClient *http.Client
+	// Cache the token is read from and stored in, DefaultCache if nil.
+	Cache *Cache
+	// Returns the username and password to request a token with. If nil only the cached
+	// token is used.
+	Credentials func(ctx context.Context) (username, password string, err error)
+
+	// Sends a request to an endpoint of the given kind, calling newRequest with the URL of
+	// each endpoint tried, so that requests can fail over between endpoints and be retried.
+	// Requests that aren't idempotent mustn't be retried once they may have been received.
+	// If nil requests are sent once to RequestURL or ReviewURL with HTTPClient.
+	Send func(kind string, newRequest func(url string) (*http.Request, error), idempotent bool) (*http.Response, error)
+	// Adds credentials to a token request, such as a one time password alongside the
+	// username and password. If nil the username and password are sent with basic auth.
+	SetCredentials func(req *http.Request, username, password string)
+	// Returns the answer to a challenge issued by the token request endpoint. If nil
+	// challenges aren't answered and the request fails with ErrBadCredentials.
+	Challenge func(ctx context.Context, challenge string) (string, error)
+	// Called after every token request and review, if set.
+	Audit func(AuditEvent)
+
+	mu sync.Mutex
+}
+
+// DefaultCache returns the cache used by token-cache-plugin when run without -token-path
+// or -cache-dir.
+func DefaultCache() (*Cache, error) {
+	currentUser, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{
+		Dir:       filepath.Join(currentUser.HomeDir, ".k8s-token-cache"),
+		TokenPath: filepath.Join(currentUser.HomeDir, ".k8s-last-token"),
+	}, nil
+}
+
+// Token returns a valid token, from the cache if the review endpoint authenticates it.
+// The cached token is read with ReadPrivateFile, so a token others could have written
+// isn't used. If no review endpoint can be reached the error is returned rather than
+// requesting a token, other review errors request a new token as a rejection would.
+func (c *Client) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cache, err := c.cache()
+	if err != nil {
+		return "", err
+	}
+	token, err := ReadPrivateFile(cache.TokenPath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if err == nil && len(token) > 0 && !expired(token, time.Now()) {
+		res, err := c.Review(ctx, token)
+		if errors.Is(err, ErrUnreachable) {
+			return "", err
+		}
+		if err == nil && res.Status.Authenticated {
+			cache.MarkReviewed(cache.TokenPath, time.Now())
+			return string(token), nil
+		}
+	}
+
+	if c.Credentials == nil {
+		return "", ErrNoToken
+	}
+	username, password, err := c.Credentials(ctx)
+	if err != nil {
+		return "", err
+	}
+	if token, err = c.Request(ctx, username, password); err != nil {
+		return "", err
+	}
+
+	entry := Entry{Endpoint: c.RequestURL, Username: username, LastReviewed: time.Now()}
+	if err = cache.Store(cache.TokenPath, token, entry); err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+// Invalidate removes token from the cache if it's still the cached token, so that the
+// next call to Token requests a new one.
+func (c *Client) Invalidate(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cache, err := c.cache()
+	if err != nil {
+		return
+	}
+	cached, err := ReadPrivateFile(cache.TokenPath)
+	if err != nil || string(cached) != token {
+		return
+	}
+	if index, err := cache.ReadIndex(); err == nil {
+		cache.Remove(index, Key(cache.TokenPath))
+	}
+}
+
+// Review sends a TokenReview of token to the review endpoint. Errors wrap ErrUnreachable
+// if no endpoint could be reached or the endpoint responded with a server error.
+// https://kubernetes.io/docs/admin/authentication/#webhook-token-authentication
+func (c *Client) Review(ctx context.Context, token []byte) (TokenReviewResponse, error) {
+	event := AuditEvent{Kind: ReviewEndpoint, Token: token}
+	res, err := c.review(ctx, token, &event)
+	if err == nil && res.Status.Authenticated {
+		event.Authenticated, event.Username = true, res.Status.User.Username
+	}
+	event.Err = err
+	c.audit(event)
+	return res, err
+}
+
+func (c *Client) review(ctx context.Context, token []byte, event *AuditEvent) (TokenReviewResponse, error) {
+	body, err := json.Marshal(NewTokenReviewRequest(token))
+	if err != nil {
+		return TokenReviewResponse{}, err
+	}
+
+	resp, err := c.send(ReviewEndpoint, func(url string) (*http.Request, error) {
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		return req.WithContext(ctx), nil
+	}, true)
+	if err != nil {
+		return TokenReviewResponse{}, fmt.Errorf("%w: %s", ErrUnreachable, err)
+	}
+	defer resp.Body.Close()
+	event.Endpoint = resp.Request.URL.String()
+
+	if resp.StatusCode >= 500 {
+		return TokenReviewResponse{}, fmt.Errorf("%w: %s returned %s", ErrUnreachable, event.Endpoint, resp.Status)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return TokenReviewResponse{}, fmt.Errorf("tokencache: token review endpoint %s returned %s", event.Endpoint, resp.Status)
+	}
+
+	res := TokenReviewResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return TokenReviewResponse{}, err
+	}
+	return res, nil
+}
+
+// Request requests a token for username. Errors wrap ErrBadCredentials if the token
+// request endpoint rejects the credentials. If Challenge is set and the endpoint responds
+// with a 401 carrying a challenge, the answer is sent back and the request retried.
+func (c *Client) Request(ctx context.Context, username, password string) ([]byte, error) {
+	event := AuditEvent{Kind: RequestEndpoint, Username: username}
+	token, err := c.request(ctx, username, password, &event)
+	event.Token, event.Err = token, err
+	c.audit(event)
+	return token, err
+}
+
+func (c *Client) request(ctx context.Context, username, password string, event *AuditEvent) ([]byte, error) {
+	challenge := http.Header{}
+	for round := 0; ; round++ {
+		resp, err := c.send(RequestEndpoint, func(url string) (*http.Request, error) {
+			req, err := http.NewRequest("GET", url, nil)
+			if err != nil {
+				return nil, err
+			}
+			if c.SetCredentials != nil {
+				c.SetCredentials(req, username, password)
+			} else {
+				req.SetBasicAuth(username, password)
+			}
+			for k, v := range challenge {
+				req.Header[k] = v
+			}
+			return req.WithContext(ctx), nil
+		}, false)
+		if err != nil {
+			return nil, err
+		}
+		event.Endpoint = resp.Request.URL.String()
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && c.Challenge != nil &&
+			resp.Header.Get(ChallengeHeader) != "" && round < maxChallengeRounds {
+			answer, err := c.Challenge(ctx, resp.Header.Get(ChallengeHeader))
+			if err != nil {
+				return nil, err
+			}
+			challenge = http.Header{}
+			challenge.Set(ChallengeResponseHeader, answer)
+			if state := resp.Header.Get(ChallengeStateHeader); state != "" {
+				challenge.Set(ChallengeStateHeader, state)
+			}
+			continue
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return nil, fmt.Errorf("%w: %s returned %s", ErrBadCredentials, event.Endpoint, resp.Status)
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return nil, fmt.Errorf("tokencache: token request endpoint %s returned %s", event.Endpoint, resp.Status)
+		}
+		return body, nil
+	}
+}
+
+func (c *Client) send(kind string, newRequest func(url string) (*http.Request, error), idempotent bool) (*http.Response, error) {
+	if c.Send != nil {
+		return c.Send(kind, newRequest, idempotent)
+	}
+	url := c.RequestURL
+	if kind == ReviewEndpoint {
+		url = c.ReviewURL
+	}
+	req, err := newRequest(url)
+	if err != nil {
+		return nil, err
+	}
+	return c.httpClient().Do(req)
+}
+
+func (c *Client) cache() (*Cache, error) {
+	if c.Cache != nil {
+		return c.Cache, nil
+	}
+	cache, err := DefaultCache()
+	if err != nil {
+		return nil, fmt.Errorf("tokencache: finding the default cache: %w", err)
+	}
+	return cache, nil
+}
+
+func (c *Client) audit(event AuditEvent) {
+	if c.Audit != nil {
+		c.Audit(event)
+	}
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Whether a token is known to have expired, tokens without an expiry never are.
+func expired(token []byte, now time.Time) bool {
+	expiry, ok := Expiry(token)
+	return ok && now.After(expiry)
+}
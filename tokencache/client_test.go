@@ -0,0 +1,205 @@
+package tokencache_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mweigel/token-cache-plugin/devserver"
+	"github.com/mweigel/token-cache-plugin/tokencache"
+)
+
+// Client of a token service issuing tokens to jdoe, caching in a temporary directory.
+func newTestClient(t *testing.T, config devserver.Config) *tokencache.Client {
+	config.Users = append(config.Users, devserver.User{Name: "jdoe", Password: "secret"})
+	server := httptest.NewServer(devserver.New(config))
+	t.Cleanup(server.Close)
+
+	dir, err := ioutil.TempDir("", "tokencache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return &tokencache.Client{
+		RequestURL: server.URL + devserver.RequestPath,
+		ReviewURL:  server.URL + devserver.ReviewPath,
+		Cache:      &tokencache.Cache{Dir: filepath.Join(dir, "cache"), TokenPath: filepath.Join(dir, "token")},
+		Credentials: func(context.Context) (string, string, error) {
+			return "jdoe", "secret", nil
+		},
+	}
+}
+
+func TestClientToken(t *testing.T) {
+	c := newTestClient(t, devserver.Config{})
+	var events []tokencache.AuditEvent
+	c.Audit = func(e tokencache.AuditEvent) { events = append(events, e) }
+
+	token, err := c.Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Credentials = nil
+	if cached, err := c.Token(context.Background()); err != nil || cached != token {
+		t.Errorf("second token = %q, %v, want cached %q", cached, err, token)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("audit events = %+v, want a request and a review", events)
+	}
+	if e := events[0]; e.Kind != tokencache.RequestEndpoint || e.Username != "jdoe" || string(e.Token) != token || e.Err != nil {
+		t.Errorf("request event = %+v", e)
+	}
+	if e := events[1]; e.Kind != tokencache.ReviewEndpoint || !e.Authenticated || e.Username != "jdoe" || e.Endpoint != c.ReviewURL {
+		t.Errorf("review event = %+v", e)
+	}
+}
+
+func TestClientInsecureCache(t *testing.T) {
+	c := newTestClient(t, devserver.Config{})
+	if _, err := c.Token(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(c.Cache.TokenPath, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Token(context.Background()); err == nil {
+		t.Error("used a cached token readable by others")
+	}
+
+	link := c.Cache.TokenPath + "-link"
+	if err := os.Symlink(c.Cache.TokenPath, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(c.Cache.TokenPath, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokencache.ReadPrivateFile(link); err == nil {
+		t.Error("read a cached token through a symlink")
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	c := newTestClient(t, devserver.Config{})
+	if _, err := c.Request(context.Background(), "jdoe", "wrong"); !errors.Is(err, tokencache.ErrBadCredentials) {
+		t.Errorf("request with the wrong password = %v, want ErrBadCredentials", err)
+	}
+	c.ReviewURL += "/missing"
+	if _, err := c.Review(context.Background(), []byte("token")); err == nil || errors.Is(err, tokencache.ErrUnreachable) {
+		t.Errorf("review answered with 404 = %v, want an error that isn't ErrUnreachable", err)
+	}
+
+	c = newTestClient(t, devserver.Config{ErrorRate: 1, ErrorStatus: http.StatusServiceUnavailable})
+	if _, err := c.Review(context.Background(), []byte("token")); !errors.Is(err, tokencache.ErrUnreachable) {
+		t.Errorf("review answered with 503 = %v, want ErrUnreachable", err)
+	}
+	if _, err := c.Request(context.Background(), "jdoe", "secret"); err == nil || errors.Is(err, tokencache.ErrBadCredentials) {
+		t.Errorf("request answered with 503 = %v, want an error that isn't ErrBadCredentials", err)
+	}
+	c.ReviewURL = "http://127.0.0.1:0"
+	if _, err := c.Review(context.Background(), []byte("token")); !errors.Is(err, tokencache.ErrUnreachable) {
+		t.Errorf("review of an unreachable endpoint = %v, want ErrUnreachable", err)
+	}
+}
+
+func TestClientHooks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-OTP") != "123456" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.Header.Get(tokencache.ChallengeResponseHeader) != "42" || r.Header.Get(tokencache.ChallengeStateHeader) != "state" {
+			w.Header().Set(tokencache.ChallengeHeader, "Answer")
+			w.Header().Set(tokencache.ChallengeStateHeader, "state")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("token"))
+	}))
+	defer server.Close()
+
+	var sent []string
+	c := &tokencache.Client{
+		Send: func(kind string, newRequest func(string) (*http.Request, error), idempotent bool) (*http.Response, error) {
+			sent = append(sent, kind)
+			req, err := newRequest(server.URL)
+			if err != nil {
+				return nil, err
+			}
+			return server.Client().Do(req)
+		},
+		SetCredentials: func(req *http.Request, username, password string) {
+			req.SetBasicAuth(username, password)
+			req.Header.Set("X-OTP", "123456")
+		},
+		Challenge: func(ctx context.Context, challenge string) (string, error) {
+			if challenge != "Answer" {
+				t.Errorf("challenge = %q, want Answer", challenge)
+			}
+			return "42", nil
+		},
+	}
+
+	token, err := c.Request(context.Background(), "jdoe", "secret")
+	if err != nil || string(token) != "token" {
+		t.Fatalf("Request = %q, %v, want token", token, err)
+	}
+	if len(sent) != 2 || sent[0] != tokencache.RequestEndpoint {
+		t.Errorf("sent %v, want two requests", sent)
+	}
+
+	c.Challenge = nil
+	if _, err = c.Request(context.Background(), "jdoe", "secret"); !errors.Is(err, tokencache.ErrBadCredentials) {
+		t.Errorf("unanswered challenge = %v, want ErrBadCredentials", err)
+	}
+}
+
+func TestClientDefaultCache(t *testing.T) {
+	// Without a Cache the default cache is used, which may or may not hold a token, but
+	// there's no endpoint to review it or credentials to request one.
+	c := &tokencache.Client{ReviewURL: "http://127.0.0.1:0"}
+	if _, err := c.Token(context.Background()); err == nil {
+		t.Error("Token without credentials or a review endpoint succeeded")
+	}
+	c.Invalidate("token")
+}
+
+func TestClientReviewErrors(t *testing.T) {
+	c := newTestClient(t, devserver.Config{})
+	token, err := c.Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A review endpoint answering with an error is treated as rejecting the token.
+	reviewURL := c.ReviewURL
+	c.ReviewURL += "/missing"
+	renewed, err := c.Token(context.Background())
+	if err != nil {
+		t.Fatalf("Token after a 404 review = %v, want a new token requested", err)
+	}
+	if renewed == token {
+		t.Error("cached token reused after a failed review")
+	}
+
+	// An unreachable review endpoint fails rather than requesting a token.
+	c.ReviewURL = "http://127.0.0.1:0"
+	c.Credentials = func(context.Context) (string, string, error) {
+		t.Error("credentials requested with the review endpoint unreachable")
+		return "jdoe", "secret", nil
+	}
+	if _, err = c.Token(context.Background()); !errors.Is(err, tokencache.ErrUnreachable) {
+		t.Errorf("Token with the review endpoint unreachable = %v, want ErrUnreachable", err)
+	}
+
+	c.ReviewURL = reviewURL
+	if cached, err := c.Token(context.Background()); err != nil || cached != renewed {
+		t.Errorf("Token = %q, %v, want cached %q", cached, err, renewed)
+	}
+}
@@ -0,0 +1,49 @@
+package tokencache
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Claims decodes the claims in a JWT's payload. The signature isn't verified, claims are only
+// used to inform the user and to avoid reusing tokens known to have expired.
+func Claims(token []byte) (map[string]interface{}, error) {
+	parts := strings.Split(string(bytes.TrimSpace(token)), ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is not a JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, err
+	}
+
+	claims := map[string]interface{}{}
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	if err = d.Decode(&claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// Expiry returns the expiry of a token taken from the exp claim, if it's a JWT that has one.
+func Expiry(token []byte) (time.Time, bool) {
+	claims, err := Claims(token)
+	if err != nil {
+		return time.Time{}, false
+	}
+	exp, ok := claims["exp"].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := exp.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package tokencache
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Flag opening a file that fails if it's a symlink.
+const openNoFollow = syscall.O_NOFOLLOW
+
+// Refuse a file owned by another user or accessible to others.
+func checkPrivate(path string, info os.FileInfo) error {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("tokencache: %s is owned by uid %d, not the current user", path, st.Uid)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("tokencache: %s has mode %s and is accessible to other users", path, info.Mode().Perm())
+	}
+	return nil
+}
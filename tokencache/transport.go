@@ -0,0 +1,140 @@
+package tokencache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Largest request body buffered so the request can be retried with a new token.
+const maxReplayBody = 1 << 20
+
+// TokenSource supplies tokens to a Transport. *Client is a TokenSource.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+	// Called with a token the server rejected, so that it isn't returned again.
+	Invalidate(token string)
+}
+
+// Transport is an http.RoundTripper adding a bearer token to requests. A new token is
+// acquired when the current one expires or the server rejects it, and the request is
+// retried if its body can be replayed. Requests wait while a token is acquired, so a
+// login prompts once.
+type Transport struct {
+	Source TokenSource
+	// Transport the requests are sent with, http.DefaultTransport if nil.
+	Base http.RoundTripper
+
+	mu      sync.Mutex
+	current string
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.token(req.Context(), "")
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	getBody, err := replayableBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := withToken(req, token, getBody)
+	if err != nil {
+		return nil, err
+	}
+	res, err := t.base().RoundTrip(r)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+
+	if token, err = t.token(req.Context(), token); err != nil {
+		return res, nil
+	}
+	if getBody == nil && req.Body != nil && req.Body != http.NoBody {
+		// The body has been sent and can't be replayed, the next request will use the new token.
+		return res, nil
+	}
+	if r, err = withToken(req, token, getBody); err != nil {
+		return res, nil
+	}
+	res.Body.Close()
+	return t.base().RoundTrip(r)
+}
+
+// Return the current token, acquiring one if there's none, it's expired or it's the
+// token the server rejected.
+func (t *Transport) token(ctx context.Context, rejected string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.current != "" && t.current == rejected {
+		t.Source.Invalidate(t.current)
+		t.current = ""
+	}
+	if expired([]byte(t.current), time.Now()) {
+		t.current = ""
+	}
+	if t.current == "" {
+		token, err := t.Source.Token(ctx)
+		if err != nil {
+			return "", err
+		}
+		t.current = token
+	}
+	return t.current, nil
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+// Copy of a request authenticated with the token in place of any credentials it had,
+// with a fresh body if it can be replayed.
+func withToken(req *http.Request, token string, getBody func() (io.ReadCloser, error)) (*http.Request, error) {
+	r := req.Clone(req.Context())
+	r.Header.Set("Authorization", "Bearer "+token)
+	if getBody != nil {
+		body, err := getBody()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = body
+	}
+	return r, nil
+}
+
+// Return a function giving a fresh copy of the request body, so the request can be
+// retried. The request's GetBody is used if set, otherwise small bodies are read into
+// memory. Returns nil if the request has no body or it can't be replayed.
+func replayableBody(req *http.Request) (func() (io.ReadCloser, error), error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody != nil {
+		req.Body.Close()
+		return req.GetBody, nil
+	}
+	if req.ContentLength <= 0 || req.ContentLength > maxReplayBody {
+		return nil, nil
+	}
+	b, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}, nil
+}
@@ -0,0 +1,220 @@
+package tokencache_test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mweigel/token-cache-plugin/tokencache"
+)
+
+// Token source handing out tokens in turn, recording those invalidated.
+type testSource struct {
+	mu          sync.Mutex
+	tokens      []string
+	err         error
+	delay       time.Duration
+	calls       int
+	invalidated []string
+}
+
+func (s *testSource) Token(ctx context.Context) (string, error) {
+	time.Sleep(s.delay)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.err != nil {
+		return "", s.err
+	}
+	token := s.tokens[0]
+	s.tokens = s.tokens[1:]
+	return token, nil
+}
+
+func (s *testSource) Invalidate(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.invalidated = append(s.invalidated, token)
+}
+
+// Server accepting tokens other than rejected, recording the token and body of each request.
+type testAPIServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	rejected string
+	seen     []string
+}
+
+func newTestAPIServer(t *testing.T, rejected string) *testAPIServer {
+	s := &testAPIServer{rejected: rejected}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		s.seen = append(s.seen, fmt.Sprintf("%s %s", r.Header.Get("Authorization"), body))
+		s.mu.Unlock()
+		if r.Header.Get("Authorization") == "Bearer "+s.rejected {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func testJWT(exp time.Time) string {
+	enc := base64.RawURLEncoding
+	payload := fmt.Sprintf(`{"sub":"jdoe","exp":%d}`, exp.Unix())
+	return enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." + enc.EncodeToString([]byte(payload)) + ".sig"
+}
+
+func TestTransport(t *testing.T) {
+	server := newTestAPIServer(t, "")
+	source := &testSource{tokens: []string{"first"}}
+	client := &http.Client{Transport: &tokencache.Transport{Source: source}}
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Basic amRvZTpzZWNyZXQ=")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if want := []string{"Bearer first ", "Bearer first "}; strings.Join(server.seen, "|") != strings.Join(want, "|") {
+		t.Errorf("server saw %q, want %q", server.seen, want)
+	}
+	if source.calls != 1 {
+		t.Errorf("token acquired %d times, want once", source.calls)
+	}
+}
+
+func TestTransportRejected(t *testing.T) {
+	server := newTestAPIServer(t, "first")
+	source := &testSource{tokens: []string{"first", "second"}}
+	client := &http.Client{Transport: &tokencache.Transport{Source: source}}
+
+	// The body is replayed with GetBody once the rejected token is replaced.
+	resp, err := client.Post(server.URL, "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %s, want 200 after retrying", resp.Status)
+	}
+	if want := []string{"Bearer first payload", "Bearer second payload"}; strings.Join(server.seen, "|") != strings.Join(want, "|") {
+		t.Errorf("server saw %q, want %q", server.seen, want)
+	}
+	if len(source.invalidated) != 1 || source.invalidated[0] != "first" {
+		t.Errorf("invalidated %q, want first", source.invalidated)
+	}
+}
+
+func TestTransportRejectedUnreplayable(t *testing.T) {
+	server := newTestAPIServer(t, "first")
+	source := &testSource{tokens: []string{"first", "second"}}
+	client := &http.Client{Transport: &tokencache.Transport{Source: source}}
+
+	// A streamed body can't be replayed, so the 401 is returned and the next request uses
+	// the new token.
+	resp, err := client.Post(server.URL, "text/plain", ioutil.NopCloser(strings.NewReader("stream")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %s, want 401", resp.Status)
+	}
+	if resp, err = client.Get(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if want := []string{"Bearer first stream", "Bearer second "}; strings.Join(server.seen, "|") != strings.Join(want, "|") {
+		t.Errorf("server saw %q, want %q", server.seen, want)
+	}
+}
+
+func TestTransportExpired(t *testing.T) {
+	server := newTestAPIServer(t, "")
+	expired, valid := testJWT(time.Now().Add(-time.Minute)), testJWT(time.Now().Add(time.Hour))
+	source := &testSource{tokens: []string{expired, valid}}
+	client := &http.Client{Transport: &tokencache.Transport{Source: source}}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// The expired token is replaced before the second request rather than after a 401,
+	// and isn't invalidated as the server never rejected it.
+	if want := []string{"Bearer " + expired + " ", "Bearer " + valid + " "}; strings.Join(server.seen, "|") != strings.Join(want, "|") {
+		t.Errorf("server saw %q, want %q", server.seen, want)
+	}
+	if len(source.invalidated) != 0 {
+		t.Errorf("invalidated %q, want none", source.invalidated)
+	}
+}
+
+func TestTransportConcurrent(t *testing.T) {
+	server := newTestAPIServer(t, "")
+	source := &testSource{tokens: []string{"first"}, delay: 50 * time.Millisecond}
+	client := &http.Client{Transport: &tokencache.Transport{Source: source}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if source.calls != 1 {
+		t.Errorf("token acquired %d times by concurrent requests, want a single login", source.calls)
+	}
+}
+
+// Request body recording whether it was closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestTransportTokenError(t *testing.T) {
+	source := &testSource{err: errors.New("no token")}
+	body := &closeRecorder{Reader: strings.NewReader("payload")}
+	req, err := http.NewRequest("POST", "http://127.0.0.1:0", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = (&tokencache.Transport{Source: source}).RoundTrip(req); err == nil {
+		t.Fatal("RoundTrip without a token succeeded")
+	}
+	if !body.closed {
+		t.Error("request body not closed")
+	}
+}
@@ -0,0 +1,42 @@
+package tokencache
+
+// TokenReviewRequest sent when verifying a cached token.
+// https://kubernetes.io/docs/admin/authentication/#webhook-token-authentication
+type TokenReviewRequest struct {
+	APIVersion string
+	Kind       string
+	Spec       map[string]string
+}
+
+// NewTokenReviewRequest returns a review of token.
+func NewTokenReviewRequest(token []byte) *TokenReviewRequest {
+	return &TokenReviewRequest{
+		APIVersion: "client.authentication.k8s.io/v1beta",
+		Kind:       "TokenReview",
+		Spec: map[string]string{
+			"token": string(token),
+		},
+	}
+}
+
+// TokenReviewResponse received when verifying a cached token.
+// https://kubernetes.io/docs/admin/authentication/#webhook-token-authentication
+type TokenReviewResponse struct {
+	APIVersion string
+	Kind       string
+	Status     Status
+}
+
+// Status of a token review.
+type Status struct {
+	Authenticated bool
+	User          User
+}
+
+// User a token authenticates as.
+type User struct {
+	Username string
+	UID      string
+	Groups   []string
+	Extra    map[string][]string
+}
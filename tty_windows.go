@@ -0,0 +1,25 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+func openTTY() (*tty, error) {
+	in, err := os.OpenFile("CONIN$", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	out, err := os.OpenFile("CONOUT$", os.O_WRONLY, 0)
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	return &tty{in: in, out: out}, nil
+}
+
+// Console control events reach every process attached to the console, including commands
+// the plugin runs.
+func terminalForeground() bool {
+	return true
+}
@@ -1,5 +1,12 @@
 package main
 
+import (
+	"strings"
+	"time"
+
+	"github.com/mweigel/token-cache-plugin/tokencache"
+)
+
 // ExecCredenital which will be printed to stdout. k8s.io/client-go will then use the
 // returned bearer token in the status when authenticating against the Kubernetes API.
 // https://kubernetes.io/docs/admin/authentication/#client-go-credential-plugins
@@ -19,51 +26,86 @@ func newExecCredential(token []byte) *execCredential {
 	}
 }
 
-// TokenReviewRequest which will be sent when verifying a cached token.
-// https://kubernetes.io/docs/admin/authentication/#webhook-token-authentication
-type tokenReviewRequest struct {
-	APIVersion string
-	Kind       string
-	Spec       map[string]string
-}
-
-func newTokenReviewRequest(token []byte) *tokenReviewRequest {
-	return &tokenReviewRequest{
-		APIVersion: "client.authentication.k8s.io/v1beta",
-		Kind:       "TokenReview",
-		Spec: map[string]string{
-			"token": string(token),
-		},
-	}
-}
+// Token reviews, shared with the tokencache package.
+type (
+	tokenReviewResponse = tokencache.TokenReviewResponse
+	status              = tokencache.Status
+	k8suser             = tokencache.User
+)
 
-// TokenReviewResponse which will be received when verifying a cached token.
-// https://kubernetes.io/docs/admin/authentication/#webhook-token-authentication
-type tokenReviewResponse struct {
-	APIVersion string
-	Kind       string
-	Status     status
+// Config populated by arguments from kubeconfig file.
+// https://kubernetes.io/docs/admin/authentication/#configuration
+type config struct {
+	tokenRequestEndpoints  stringSlice
+	tokenReviewEndpoints   stringSlice
+	clientCertOnly         bool
+	tls                    tlsSettings
+	requestTLS             tlsSettings
+	reviewTLS              tlsSettings
+	proxy                  string
+	noProxy                string
+	connectTimeout         time.Duration
+	tlsHandshakeTimeout    time.Duration
+	timeout                time.Duration
+	maxRetries             int
+	retryDelay             time.Duration
+	retryMaxDelay          time.Duration
+	cacheTokens            bool
+	tokenPath              string
+	cacheDir               string
+	username               string
+	useOSUsername          bool
+	pinentry               string
+	otpMode                string
+	otpHeader              string
+	totpSecretFile         string
+	challengeResponse      bool
+	revocationEndpoint     string
+	revocationMethod       string
+	format                 string
+	verbosity              int
+	logFormat              string
+	auditLog               string
+	auditLogMaxSize        int64
+	auditLogMaxBackups     int
+	strictModes            string
+	offlineGrace           time.Duration
+	maxLoginFailures       int
+	loginFailureWindow     time.Duration
+	reviewCacheTTL         time.Duration
+	reviewCacheNegativeTTL time.Duration
+	dockerRegistries       stringSlice
+	output                 string
+	outputEnvVar           string
+	execEnvVar             string
+	execKubeconfig         bool
+	apiServer              string
+	apiServerCA            string
+	kubeContext            string
+	listen                 string
+	acceptHosts            string
+	devUsers               string
+	devTokenTTL            time.Duration
+	devLatency             time.Duration
+	devErrorRate           float64
+	devErrorStatus         int
+	devMalformedRate       float64
+	devTLSCert             string
+	devTLSKey              string
 }
 
-type status struct {
-	Authenticated bool
-	User          k8suser
-}
+// Flag which may be repeated or given a comma separated list of values.
+type stringSlice []string
 
-type k8suser struct {
-	Username string
-	UID      string
-	Groups   []string
-	Extra    map[string][]string
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
 }
 
-// Config populated by arguments from kubeconfig file.
-// https://kubernetes.io/docs/admin/authentication/#configuration
-type config struct {
-	tokenRequestEndpoint string
-	tokenReviewEndpoint  string
-	caCert               string
-	skipTLSVerification  bool
-	cacheTokens          bool
-	tokenPath            string
+func (s *stringSlice) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*s = append(*s, v)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mweigel/token-cache-plugin/tokencache"
+)
+
+// Formats whoami can print the identity in.
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+	formatYAML  = "yaml"
+)
+
+// Identity associated with a token as reported by the token review endpoint.
+type identity struct {
+	Username          string              `json:"username"`
+	UID               string              `json:"uid"`
+	Groups            []string            `json:"groups"`
+	Extra             map[string][]string `json:"extra,omitempty"`
+	ExpiresAt         *time.Time          `json:"expiresAt,omitempty"`
+	RemainingLifetime string              `json:"remainingLifetime,omitempty"`
+}
+
+func newIdentity(token []byte, user k8suser, now time.Time) identity {
+	id := identity{
+		Username: user.Username,
+		UID:      user.UID,
+		Groups:   user.Groups,
+		Extra:    user.Extra,
+	}
+	if expiry, ok := tokencache.Expiry(token); ok {
+		id.ExpiresAt = &expiry
+		id.RemainingLifetime = expiry.Sub(now).Truncate(time.Second).String()
+	}
+	return id
+}
+
+// Review the cached token and print the identity it's associated with, which is useful
+// when debugging RBAC.
+func whoami(logger *leveledLogger) {
+	_, reviewClient, err := getHTTPClients(logger)
+	if err != nil {
+		logger.Fatalf("Error creating HTTP client: %s\n", err)
+	}
+
+	token, err := readCachedToken(cfg.tokenPath, logger)
+	if err != nil {
+		logger.Fatalf("Error reading cached token: %s\n", err)
+	}
+	logger.addSecret(string(token))
+
+	tokenResponse, err := reviewToken(reviewClient, token)
+	if err != nil {
+		logger.Fatalf("Error reviewing cached token: %s\n", err)
+	}
+	if !tokenResponse.Status.Authenticated {
+		logger.Fatalf("Cached token is not authenticated, run kubectl to log in again\n")
+	}
+
+	id := newIdentity(token, tokenResponse.Status.User, time.Now())
+	if err = printIdentity(stdout, id, cfg.format); err != nil {
+		logger.Fatalf("Unable to output identity: %s\n", err)
+	}
+}
+
+func printIdentity(w io.Writer, id identity, format string) error {
+	switch format {
+	case formatTable:
+		return printIdentityTable(w, id)
+	case formatJSON:
+		b, err := json.MarshalIndent(id, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	case formatYAML:
+		return printIdentityYAML(w, id)
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+func printIdentityTable(w io.Writer, id identity) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "USERNAME\t%s\n", id.Username)
+	fmt.Fprintf(tw, "UID\t%s\n", id.UID)
+	fmt.Fprintf(tw, "GROUPS\t%s\n", strings.Join(id.Groups, ", "))
+	for _, k := range sortedKeys(id.Extra) {
+		fmt.Fprintf(tw, "EXTRA %s\t%s\n", k, strings.Join(id.Extra[k], ", "))
+	}
+	if id.ExpiresAt != nil {
+		fmt.Fprintf(tw, "EXPIRES\t%s (%s)\n", id.ExpiresAt.Format(time.RFC3339), id.RemainingLifetime)
+	} else {
+		fmt.Fprintf(tw, "EXPIRES\tunknown\n")
+	}
+	return tw.Flush()
+}
+
+// YAML is written by hand to avoid a dependency. Strings are double quoted, which in YAML
+// uses the same escapes as Go.
+func printIdentityYAML(w io.Writer, id identity) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "username: %s\n", strconv.Quote(id.Username))
+	fmt.Fprintf(&b, "uid: %s\n", strconv.Quote(id.UID))
+	writeYAMLList(&b, "groups", id.Groups, "")
+	if len(id.Extra) > 0 {
+		b.WriteString("extra:\n")
+		for _, k := range sortedKeys(id.Extra) {
+			writeYAMLList(&b, strconv.Quote(k), id.Extra[k], "  ")
+		}
+	}
+	if id.ExpiresAt != nil {
+		fmt.Fprintf(&b, "expiresAt: %s\n", strconv.Quote(id.ExpiresAt.Format(time.RFC3339)))
+		fmt.Fprintf(&b, "remainingLifetime: %s\n", strconv.Quote(id.RemainingLifetime))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeYAMLList(b *strings.Builder, key string, values []string, indent string) {
+	if len(values) == 0 {
+		fmt.Fprintf(b, "%s%s: []\n", indent, key)
+		return
+	}
+	fmt.Fprintf(b, "%s%s:\n", indent, key)
+	for _, v := range values {
+		fmt.Fprintf(b, "%s- %s\n", indent, strconv.Quote(v))
+	}
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
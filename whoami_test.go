@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Unsigned JWT expiring at exp.
+func testJWT(exp time.Time) []byte {
+	enc := base64.RawURLEncoding
+	payload := fmt.Sprintf(`{"sub":"jdoe","exp":%d}`, exp.Unix())
+	return []byte(enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." + enc.EncodeToString([]byte(payload)) + ".sig")
+}
+
+func TestPrintIdentity(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	user := k8suser{
+		Username: "jdoe",
+		UID:      "1000",
+		Groups:   []string{"developers", "-admins", "yes", "ops: oncall", "# team"},
+		Extra:    map[string][]string{"example.com/scopes": {"read: all", `say "hi"`}},
+	}
+	withExpiry := newIdentity(testJWT(now.Add(90*time.Minute)), user, now)
+	noExpiry := newIdentity([]byte("opaque"), k8suser{Username: "svc"}, now)
+
+	tests := []struct {
+		name   string
+		id     identity
+		format string
+		want   string
+	}{
+		{"table", withExpiry, formatTable, `USERNAME                  jdoe
+UID                       1000
+GROUPS                    developers, -admins, yes, ops: oncall, # team
+EXTRA example.com/scopes  read: all, say "hi"
+EXPIRES                   2026-10-18T13:30:00Z (1h30m0s)
+`},
+		{"table without expiry", noExpiry, formatTable, `USERNAME  svc
+UID       
+GROUPS    
+EXPIRES   unknown
+`},
+		{"json", withExpiry, formatJSON, `{
+  "username": "jdoe",
+  "uid": "1000",
+  "groups": [
+    "developers",
+    "-admins",
+    "yes",
+    "ops: oncall",
+    "# team"
+  ],
+  "extra": {
+    "example.com/scopes": [
+      "read: all",
+      "say \"hi\""
+    ]
+  },
+  "expiresAt": "2026-10-18T13:30:00Z",
+  "remainingLifetime": "1h30m0s"
+}
+`},
+		{"json without expiry", noExpiry, formatJSON, `{
+  "username": "svc",
+  "uid": "",
+  "groups": null
+}
+`},
+		{"yaml", withExpiry, formatYAML, `username: "jdoe"
+uid: "1000"
+groups:
+- "developers"
+- "-admins"
+- "yes"
+- "ops: oncall"
+- "# team"
+extra:
+  "example.com/scopes":
+  - "read: all"
+  - "say \"hi\""
+expiresAt: "2026-10-18T13:30:00Z"
+remainingLifetime: "1h30m0s"
+`},
+		{"yaml without expiry", noExpiry, formatYAML, `username: "svc"
+uid: ""
+groups: []
+`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := printIdentity(&b, test.id, test.format); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != test.want {
+				t.Errorf("output:\n%s\nwant:\n%s", b.String(), test.want)
+			}
+		})
+	}
+
+	if err := printIdentity(&bytes.Buffer{}, noExpiry, "xml"); err == nil {
+		t.Error("unknown format accepted")
+	}
+}